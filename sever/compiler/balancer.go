@@ -27,7 +27,7 @@ func (dm *DockerManager) FindContainer(lang string) (string, error) {
 	}
 
 	if bestContainerID == "" {
-		id, err := dm.CreateContainer(lang)
+		id, err := dm.newContainer(lang)
 		if err != nil {
 			return "", fmt.Errorf("failed to create container: %w", err)
 		}
@@ -38,7 +38,7 @@ func (dm *DockerManager) FindContainer(lang string) (string, error) {
 	}
 
 	if dm.reusableContainers[lang][bestContainerID] >= MAX_USERS {
-		id, err := dm.CreateContainer(lang)
+		id, err := dm.newContainer(lang)
 		if err != nil {
 			return "", fmt.Errorf("failed to create container: %w", err)
 		}
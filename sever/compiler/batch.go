@@ -0,0 +1,240 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"unicode/utf8"
+)
+
+// ExecuteRequest is a non-interactive run: the whole stdin is known upfront.
+type ExecuteRequest struct {
+	Language string `json:"language"`
+	Source
+	Stdin    string    `json:"stdin"`
+	Args     []string  `json:"args"`
+	Flags    RunFlags  `json:"flags"`
+	Limits   RunLimits `json:"limits"`
+	Callback *Callback `json:"callback,omitempty"`
+}
+
+type ExecuteResult struct {
+	RunID         string       `json:"run_id"`
+	Stdout        string       `json:"stdout"`
+	Stderr        string       `json:"stderr"`
+	Encoding      string       `json:"encoding,omitempty"`
+	CompileOutput string       `json:"compile_output,omitempty"`
+	Diagnostics   []Diagnostic `json:"diagnostics,omitempty"`
+	RunSummary
+}
+
+func (req ExecuteRequest) Validate() error {
+	if _, ok := LangImages[req.Language]; !ok {
+		return fmt.Errorf("unsupported language: %s", req.Language)
+	}
+	if err := req.Source.Validate(req.Language); err != nil {
+		return err
+	}
+	if err := req.Flags.Validate(req.Language); err != nil {
+		return err
+	}
+	return req.Callback.Validate()
+}
+
+// outputCollector is the sender of batch runs, it keeps the output in memory
+// instead of streaming it. The run's output caps bound its size.
+type outputCollector struct {
+	mu     sync.Mutex
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (c *outputCollector) Send(msgType, runID string, payload any) error {
+	p, ok := payload.(OutputPayload)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.Stream == STREAM_STDERR {
+		c.stderr.Write(p.Bytes())
+	} else {
+		c.stdout.Write(p.Bytes())
+	}
+	return nil
+}
+
+// contents returns the output collected so far, base64 encoded when it is
+// not valid UTF-8.
+func (c *outputCollector) contents() (string, string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stdout, stderr := c.stdout.Bytes(), c.stderr.Bytes()
+	if utf8.Valid(stdout) && utf8.Valid(stderr) {
+		return string(stdout), string(stderr), ""
+	}
+	return base64.StdEncoding.EncodeToString(stdout), base64.StdEncoding.EncodeToString(stderr), ENCODING_BASE64
+}
+
+// outputBytes returns the raw stdout and stderr of the run.
+func (r *ExecuteResult) outputBytes() ([]byte, []byte, error) {
+	if r.Encoding != ENCODING_BASE64 {
+		return []byte(r.Stdout), []byte(r.Stderr), nil
+	}
+	stdout, err := base64.StdEncoding.DecodeString(r.Stdout)
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := base64.StdEncoding.DecodeString(r.Stderr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+// batchControl lets the owner of a batch run follow and stop it. All fields
+// are optional.
+type batchControl struct {
+	stop     <-chan struct{}
+	onState  func(state string)
+	onQueued func(position int) // where the compile waits, see compileCaller
+	out      *outputCollector
+}
+
+func (ctl *batchControl) state(state string) {
+	if ctl != nil && ctl.onState != nil {
+		ctl.onState(state)
+	}
+}
+
+func (ctl *batchControl) compileCaller(runID string) compileCaller {
+	caller := compileCaller{id: runID}
+	if ctl != nil {
+		caller.onQueued = ctl.onQueued
+	}
+	return caller
+}
+
+func (ctl *batchControl) stopped() <-chan struct{} {
+	if ctl == nil {
+		return nil
+	}
+	return ctl.stop
+}
+
+// Execute runs a snippet to completion on a pooled container.
+func (dm *DockerManager) Execute(req ExecuteRequest) (*ExecuteResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	containerID, err := dm.FindContainer(req.Language)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+	defer func() {
+		if err := dm.DecreaseUser(containerID); err != nil {
+			log.Printf("Failed to remove container %s: %v", containerID, err)
+		}
+	}()
+
+	result, err := dm.executeIn(containerID, req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.webhooks.Notify(req.Callback, EVENT_RUN_COMPLETED, result.RunID, result)
+	return result, nil
+}
+
+// executeIn compiles and runs req in a container already assigned to the caller.
+func (dm *DockerManager) executeIn(containerID string, req ExecuteRequest, ctl *batchControl) (*ExecuteResult, error) {
+	opt := LangImages[req.Language]
+	result := &ExecuteResult{RunID: newID()}
+
+	// Stopped before it started, there is nothing to compile for
+	select {
+	case <-ctl.stopped():
+		result.ExitCode = -1
+		result.Reason = EXIT_REASON_USER_STOP
+		return result, nil
+	default:
+	}
+
+	ctl.state(JOB_COMPILING)
+	cmd, err := dm.buildCommand(req.Language, ctl.compileCaller(result.RunID), req.Source, req.Flags)
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) {
+		result.CompileOutput = compileErr.Output
+		result.Diagnostics = compileErr.Diagnostics
+		result.ExitCode = -1
+		result.Reason = EXIT_REASON_COMPILE_ERROR
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	spec := execSpec{
+		runID:  result.RunID,
+		cmd:    append(cmd, req.Args...),
+		limits: req.Limits,
+	}
+	spec.applyLimits(opt)
+
+	run, err := dm.runBatch(containerID, opt, spec, req.Stdin, ctl)
+	if err != nil {
+		return nil, err
+	}
+	run.CompileOutput = result.CompileOutput
+	return run, nil
+}
+
+// runBatch runs an already built command with the whole stdin fed upfront.
+func (dm *DockerManager) runBatch(containerID string, opt LangOptions, spec execSpec, stdin string, ctl *batchControl) (*ExecuteResult, error) {
+	result := &ExecuteResult{RunID: spec.runID}
+
+	select {
+	case <-ctl.stopped():
+		result.ExitCode = -1
+		result.Reason = EXIT_REASON_USER_STOP
+		return result, nil
+	default:
+	}
+
+	out := &outputCollector{}
+	if ctl != nil && ctl.out != nil {
+		out = ctl.out
+	}
+	e, err := dm.startExec(containerID, opt, spec, out, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctl.state(JOB_RUNNING)
+
+	// The program may never read its input, so feed it without blocking the wait
+	go func() {
+		if _, err := io.WriteString(e.hijackedResp.Conn, stdin); err != nil {
+			return
+		}
+		e.hijackedResp.CloseWrite()
+	}()
+
+	select {
+	case <-e.outputDone:
+	case <-e.ctx.Done():
+	case <-ctl.stopped():
+		e.run.setReason(EXIT_REASON_USER_STOP)
+	}
+
+	result.RunSummary = dm.finishExec(e, out)
+
+	result.Stdout, result.Stderr, result.Encoding = out.contents()
+	return result, nil
+}
@@ -0,0 +1,169 @@
+package compiler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	COMPILE_CACHE_BYTES = 1024 * 1024 * 1024
+	// Evicted builds stay on disk a while longer for the runs still using them
+	COMPILE_CACHE_GRACE = 10 * time.Minute
+)
+
+type CompileCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// cachedBuild is a successful compile: the build directory and the command
+// that runs it, before runtime flags.
+type cachedBuild struct {
+	key  string
+	dir  string
+	run  []string
+	size int64
+}
+
+// CompileCache maps the hash of everything a compile depends on to its build,
+// evicting the least recently used builds past maxBytes. Installed package
+// sets are cached the same way, with their environment as the command.
+type CompileCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	entries  map[string]*list.Element
+	lru      *list.List // front is the most recently used
+	stats    CompileCacheStats
+}
+
+func NewCompileCache(maxBytes int64) *CompileCache {
+	return &CompileCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the run command of the cached build for key.
+func (c *CompileCache) Get(key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(el)
+	build := el.Value.(*cachedBuild)
+	log.Printf("compile cache hit: %s", key)
+	return append([]string(nil), build.run...), true
+}
+
+// Put caches the build in dir, which the cache owns from now on.
+func (c *CompileCache) Put(key, dir string, run []string) {
+	size, err := dirSize(dir)
+	if err != nil {
+		log.Printf("failed to size build %s: %v", dir, err)
+		removeAfter(dir, COMPILE_CACHE_GRACE)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Compiled twice at the same time, the caller still runs its own copy
+	if _, ok := c.entries[key]; ok || size > c.maxBytes {
+		removeAfter(dir, COMPILE_CACHE_GRACE)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cachedBuild{key: key, dir: dir, run: run, size: size})
+	c.stats.Bytes += size
+	for c.stats.Bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		build := oldest.Value.(*cachedBuild)
+		c.lru.Remove(oldest)
+		delete(c.entries, build.key)
+		c.stats.Bytes -= build.size
+		c.stats.Evictions++
+		removeAfter(build.dir, COMPILE_CACHE_GRACE)
+	}
+}
+
+func (c *CompileCache) Stats() CompileCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+// compileKey hashes everything a build depends on: the language, the exact
+// compile image, the preamble, the compiler flags and the sources.
+func (dm *DockerManager) compileKey(lang string, flags RunFlags, files map[string]string, extra ...string) string {
+	opt := LangImages[lang]
+	h := sha256.New()
+	writeKeyParts(h, lang, opt.CompileImage, dm.imageIDs[opt.CompileImage], opt.Preamble)
+	writeKeyParts(h, flags.Compile...)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeKeyParts(h, name, files[name])
+	}
+	writeKeyParts(h, extra...)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeKeyParts writes the parts so that no two lists hash the same.
+func writeKeyParts(h hash.Hash, parts ...string) {
+	fmt.Fprintf(h, "%d;", len(parts))
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func removeAfter(dir string, d time.Duration) {
+	time.AfterFunc(d, func() { os.RemoveAll(dir) })
+}
+
+func (dm *DockerManager) CompileCache() *CompileCache {
+	return dm.compileCache
+}
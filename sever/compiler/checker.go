@@ -0,0 +1,225 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+const (
+	CHECKER_WALL_TIME_MS = 10_000
+	CHECKER_CPU_TIME_MS  = 5_000
+	CHECKER_OUTPUT_BYTES = 64 * 1024
+	CHECKER_MESSAGE_MAX  = 4096
+)
+
+// Exit codes of a checker program.
+const (
+	CHECKER_ACCEPTED     = 0
+	CHECKER_WRONG_ANSWER = 1
+	CHECKER_PARTIAL      = 2
+)
+
+// Checker decides the verdict of a case instead of comparing outputs. It is
+// run as `<program> <input> <expected> <output>` with paths to the three
+// files and exits with CHECKER_ACCEPTED, CHECKER_WRONG_ANSWER or
+// CHECKER_PARTIAL. Its stdout is the message shown with the verdict; for a
+// partial answer the first token of stdout is the score, between 0 and 1.
+type Checker struct {
+	Language string    `json:"language"`
+	Code     string    `json:"code"`
+	Limits   RunLimits `json:"limits"`
+}
+
+func (c *Checker) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if _, ok := LangImages[c.Language]; !ok {
+		return fmt.Errorf("unsupported checker language: %s", c.Language)
+	}
+	if c.Code == "" {
+		return errors.New("checker code is required")
+	}
+	return nil
+}
+
+// judgeProgram is a compiled checker or interactor on a container of its
+// own. Only that container mounts dir, where the files of the cases go.
+type judgeProgram struct {
+	containerID string
+	dir         string
+	opt         LangOptions
+	cmd         []string
+	limits      RunLimits
+	deadline    time.Time // of the whole judge or stress test, none when zero
+}
+
+type checkResult struct {
+	verdict string
+	score   float64
+	message string
+}
+
+type judgeFile struct {
+	name string
+	data []byte
+}
+
+// startJudgeProgram starts a private container for a checker or interactor
+// and compiles it. The caller must close the returned program.
+func (dm *DockerManager) startJudgeProgram(lang, code string, limits RunLimits) (*judgeProgram, error) {
+	dir := filepath.Join(JUDGE_FILES, "judge-"+newToken())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create judge files: %w", err)
+	}
+
+	containerID, err := dm.startContainer(lang, mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   dir,
+		Target:   CONTAINER_JUDGE_FILES,
+		ReadOnly: true,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start judge program container: %w", err)
+	}
+
+	p := &judgeProgram{
+		containerID: containerID,
+		dir:         dir,
+		opt:         LangImages[lang],
+		limits:      limits,
+	}
+	p.cmd, err = dm.buildCommand(lang, compileCaller{id: newID()}, Source{Code: code}, RunFlags{})
+	if err != nil {
+		dm.closeJudgeProgram(p)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (dm *DockerManager) closeJudgeProgram(p *judgeProgram) {
+	if err := dm.cli.ContainerRemove(context.Background(), p.containerID, container.RemoveOptions{Force: true}); err != nil {
+		log.Printf("Failed to remove container %s: %v", p.containerID, err)
+	}
+	os.RemoveAll(p.dir)
+}
+
+// writeFiles shares the files of one case with the judge program through its
+// private mount. It returns the host directory to remove afterwards and the
+// container paths of the files.
+func (p *judgeProgram) writeFiles(files ...judgeFile) (string, []string, error) {
+	id := "case-" + newID()
+	dir := filepath.Join(p.dir, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create judge files: %w", err)
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), f.data, 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("failed to write judge files: %w", err)
+		}
+		paths = append(paths, CONTAINER_JUDGE_FILES+"/"+id+"/"+f.name)
+	}
+	return dir, paths, nil
+}
+
+// startChecker compiles the checker and caps its limits.
+func (dm *DockerManager) startChecker(c *Checker) (*judgeProgram, error) {
+	limits := c.Limits
+	if limits.WallTimeMs <= 0 || limits.WallTimeMs > CHECKER_WALL_TIME_MS {
+		limits.WallTimeMs = CHECKER_WALL_TIME_MS
+	}
+	if limits.CPUTimeMs <= 0 || limits.CPUTimeMs > CHECKER_CPU_TIME_MS {
+		limits.CPUTimeMs = CHECKER_CPU_TIME_MS
+	}
+	limits.OutputBytes = CHECKER_OUTPUT_BYTES
+
+	return dm.startJudgeProgram(c.Language, c.Code, limits)
+}
+
+// check runs the checker on one case.
+func (dm *DockerManager) check(ch *judgeProgram, tc TestCase, output []byte) (checkResult, error) {
+	dir, paths, err := ch.writeFiles(
+		judgeFile{"input", []byte(tc.Stdin)},
+		judgeFile{"expected", []byte(tc.Expected)},
+		judgeFile{"output", output},
+	)
+	if err != nil {
+		return checkResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	spec := execSpec{
+		runID:  newID(),
+		cmd:    append(append([]string(nil), ch.cmd...), paths...),
+		limits: ch.limits,
+	}
+	spec.applyLimits(ch.opt)
+	spec.capWallTime(ch.deadline)
+
+	run, err := dm.runBatch(ch.containerID, ch.opt, spec, "", nil)
+	if err != nil {
+		return checkResult{}, err
+	}
+	stdout, _, err := run.outputBytes()
+	if err != nil {
+		return checkResult{verdict: VERDICT_CHECKER_ERROR, message: "checker output is not valid"}, nil
+	}
+	return judgeVerdict(run.RunSummary, stdout, "checker"), nil
+}
+
+// judgeVerdict turns the exit status of a checker or interactor into a
+// verdict, message holds what it reported.
+func judgeVerdict(summary RunSummary, output []byte, program string) checkResult {
+	message := strings.TrimSpace(string(output))
+	if len(message) > CHECKER_MESSAGE_MAX {
+		message = message[:CHECKER_MESSAGE_MAX]
+	}
+
+	if summary.Reason != EXIT_REASON_EXITED {
+		return checkResult{
+			verdict: VERDICT_CHECKER_ERROR,
+			message: fmt.Sprintf("%s ended with %s", program, summary.Reason),
+		}
+	}
+
+	switch summary.ExitCode {
+	case CHECKER_ACCEPTED:
+		return checkResult{verdict: VERDICT_ACCEPTED, score: 1, message: message}
+	case CHECKER_WRONG_ANSWER:
+		return checkResult{verdict: VERDICT_WRONG_ANSWER, message: message}
+	case CHECKER_PARTIAL:
+		token, rest, _ := strings.Cut(message, "\n")
+		token, extra, _ := strings.Cut(strings.TrimSpace(token), " ")
+		score, err := strconv.ParseFloat(token, 64)
+		if err != nil || score < 0 || score > 1 {
+			return checkResult{
+				verdict: VERDICT_CHECKER_ERROR,
+				message: fmt.Sprintf("invalid partial score %q", token),
+			}
+		}
+		return checkResult{
+			verdict: VERDICT_PARTIAL,
+			score:   score,
+			message: strings.TrimSpace(extra + "\n" + rest),
+		}
+	default:
+		return checkResult{
+			verdict: VERDICT_CHECKER_ERROR,
+			message: fmt.Sprintf("%s exited with code %d: %s", program, summary.ExitCode, message),
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package compiler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+)
+
+const (
+	COMPILE_TIME_LIMIT   = 30 * time.Second
+	COMPILE_MEMORY       = 1024 * 1024 * 1024
+	COMPILE_CPU          = 2 // in CPU_UNIT
+	COMPILE_OUTPUT_LIMIT = 64 * 1024
+	COMPILE_FILE_LIMIT   = 64 * 1024 * 1024 // largest file the compiler may write
+	NOBODY_UID           = 65534
+	TSC_IMAGE            = "online-ide-tsc:5.8"
+)
+
+// Compile images that are not published anywhere and are built on start
+var builtImages = map[string]string{
+	TSC_IMAGE: "FROM node:22.14-alpine\nRUN npm install -g typescript@5.8\n",
+}
+
+// ensureImage pulls the image, or builds it when it is one of ours, unless
+// it is already there. It returns the image ID.
+func ensureImage(ctx context.Context, cli *client.Client, name string) (string, error) {
+	if inspect, err := cli.ImageInspect(ctx, name); err == nil {
+		return inspect.ID, nil
+	}
+	if err := fetchImage(ctx, cli, name); err != nil {
+		return "", err
+	}
+	inspect, err := cli.ImageInspect(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image: %w", err)
+	}
+	return inspect.ID, nil
+}
+
+func fetchImage(ctx context.Context, cli *client.Client, name string) error {
+	dockerfile, ok := builtImages[name]
+	if !ok {
+		rc, err := cli.ImagePull(ctx, name, image.PullOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to pull image: %w", err)
+		}
+		defer rc.Close()
+		return readProgress(rc)
+	}
+
+	var buildContext bytes.Buffer
+	tw := tar.NewWriter(&buildContext)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	resp, err := cli.ImageBuild(ctx, &buildContext, types.ImageBuildOptions{
+		Tags:   []string{name},
+		Remove: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build image: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := readProgress(resp.Body); err != nil {
+		return fmt.Errorf("failed to build image %s: %w", name, err)
+	}
+	return nil
+}
+
+// readProgress waits for a pull or build to finish and returns the error it
+// reported, if any.
+func readProgress(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// newBuildDir creates a directory for one build under the compiled files,
+// which the run containers see. Successful compiles hand it to the compile
+// cache.
+func newBuildDir(prefix string) (string, error) {
+	dir := filepath.Join(COMPILED_FILES, prefix+"-"+newToken())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create build directory: %w", err)
+	}
+	return dir, nil
+}
+
+// compileUser is who the compiler runs as. Root hands the build directory to
+// nobody, any other user compiles as itself so it can still clean up.
+func compileUser(dir string) (string, error) {
+	if os.Getuid() != 0 {
+		return fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), nil
+	}
+	err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, NOBODY_UID, NOBODY_UID)
+	})
+	return fmt.Sprintf("%d:%d", NOBODY_UID, NOBODY_UID), err
+}
+
+// compileInSandbox runs the compiler in a throwaway container of the compile
+// image, see runInSandbox. It returns the compiler output and whether it
+// succeeded.
+func (dm *DockerManager) compileInSandbox(opt LangOptions, dir string, cmd []string) (string, bool, error) {
+	return dm.runInSandbox(sandboxSpec{
+		name:      "compilation",
+		image:     opt.CompileImage,
+		env:       opt.Env,
+		dir:       dir,
+		cmd:       cmd,
+		timeLimit: COMPILE_TIME_LIMIT,
+	})
+}
+
+// sandboxSpec is a build step run in a throwaway container.
+type sandboxSpec struct {
+	name      string // for messages
+	image     string
+	env       []string
+	dir       string // the only host directory it may write
+	cmd       []string
+	readOnly  []mount.Mount
+	timeLimit time.Duration
+}
+
+// runInSandbox runs spec in a throwaway container. It has no network, sees
+// nothing of the host but its directories (at the same path, so messages name
+// the same files) and is killed after the time limit. It returns the output
+// and whether the command succeeded.
+func (dm *DockerManager) runInSandbox(spec sandboxSpec) (string, bool, error) {
+	ctx := context.Background()
+
+	user, err := compileUser(spec.dir)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to prepare build directory: %w", err)
+	}
+
+	config := &container.Config{
+		Image:           spec.image,
+		Cmd:             spec.cmd,
+		WorkingDir:      spec.dir,
+		User:            user,
+		Env:             append([]string{"HOME=/tmp"}, spec.env...),
+		NetworkDisabled: true,
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:   mount.TypeBind,
+			Source: spec.dir,
+			Target: spec.dir,
+		},
+	}
+	for _, m := range spec.readOnly {
+		m.ReadOnly = true
+		mounts = append(mounts, m)
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode:    "none",
+		SecurityOpt:    []string{"no-new-privileges"},
+		CapDrop:        []string{"ALL"},
+		ReadonlyRootfs: true,
+		Tmpfs:          map[string]string{"/tmp": "rw,noexec,size=256m"},
+
+		Resources: container.Resources{
+			Memory:     COMPILE_MEMORY,
+			MemorySwap: COMPILE_MEMORY,
+			CPUPeriod:  100000,
+			CPUQuota:   COMPILE_CPU * CPU_UNIT,
+			PidsLimit:  func(i int64) *int64 { return &i }(64),
+			Ulimits: []*units.Ulimit{
+				{
+					Name: "nofile",
+					Hard: 256,
+					Soft: 256,
+				},
+				{
+					Name: "fsize",
+					Hard: COMPILE_FILE_LIMIT,
+					Soft: COMPILE_FILE_LIMIT,
+				},
+			},
+		},
+
+		Mounts: mounts,
+	}
+
+	resp, err := dm.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create %s container: %w", spec.name, err)
+	}
+	defer func() {
+		if err := dm.cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true}); err != nil {
+			log.Printf("failed to remove %s container: %v", spec.name, err)
+		}
+	}()
+
+	waitCh, errCh := dm.cli.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	if err := dm.cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return "", false, fmt.Errorf("failed to start %s container: %w", spec.name, err)
+	}
+
+	var exitCode int64
+	timer := time.NewTimer(spec.timeLimit)
+	defer timer.Stop()
+	select {
+	case res := <-waitCh:
+		exitCode = res.StatusCode
+	case err := <-errCh:
+		return "", false, fmt.Errorf("failed to wait for %s container: %w", spec.name, err)
+	case <-timer.C:
+		log.Printf("%s timed out in container %s", spec.name, resp.ID)
+		return fmt.Sprintf("%s timed out after %s", spec.name, spec.timeLimit), false, nil
+	}
+
+	logs, err := dm.cli.ContainerLogs(ctx, resp.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s output: %w", spec.name, err)
+	}
+	defer logs.Close()
+
+	var out bytes.Buffer
+	w := &limitedWriter{w: &out, n: COMPILE_OUTPUT_LIMIT}
+	if _, err := stdcopy.StdCopy(w, w, logs); err != nil {
+		return "", false, fmt.Errorf("failed to read %s output: %w", spec.name, err)
+	}
+	if w.truncated {
+		out.WriteString("\n... output truncated")
+	}
+
+	return out.String(), exitCode == 0, nil
+}
+
+// limitedWriter keeps the first n bytes and drops the rest.
+type limitedWriter struct {
+	w         io.Writer
+	n         int
+	truncated bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		l.truncated = true
+		if _, err := l.w.Write(p[:l.n]); err != nil {
+			return 0, err
+		}
+		l.n = 0
+		return len(p), nil
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
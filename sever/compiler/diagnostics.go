@@ -0,0 +1,187 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+	SEVERITY_NOTE    = "note"
+)
+
+// Diagnostic is one compiler message. Line and Column are 1-based, 0 when
+// the compiler did not report them.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Code     string `json:"code,omitempty"`
+}
+
+// CheckRequest compiles code without running it.
+type CheckRequest struct {
+	Language string `json:"language"`
+	Source
+	Flags RunFlags `json:"flags"`
+}
+
+type CheckResult struct {
+	Success     bool         `json:"success"`
+	Output      string       `json:"output,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+var (
+	// main.c:3:5: error: expected ';' before 'return' [-Werror=...]
+	gccDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note): (.*?)(?: \[(-W[^\]]+)\])?$`)
+	// Main.java:3: error: ';' expected
+	javacDiagnostic = regexp.MustCompile(`^(.+?\.java):(\d+): (error|warning): (?:\[([\w-]+)\] )?(.*)$`)
+	// code.ts(3,5): error TS2322: Type 'string' is not assignable to type 'number'.
+	tscDiagnostic = regexp.MustCompile(`^(.+?)\((\d+),(\d+)\): (error|warning|message) (TS\d+): (.*)$`)
+)
+
+func (req CheckRequest) Validate() error {
+	opt, ok := LangImages[req.Language]
+	if !ok {
+		return fmt.Errorf("unsupported language: %s", req.Language)
+	}
+	if !opt.IsCompiled {
+		return fmt.Errorf("check is only supported for compiled languages")
+	}
+	if err := req.Source.Validate(req.Language); err != nil {
+		return err
+	}
+	return req.Flags.Validate(req.Language)
+}
+
+// Check compiles the code in the sandbox and reports the diagnostics.
+func (dm *DockerManager) Check(req CheckRequest) (*CheckResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	return dm.compileCheck(req.Language, compileCaller{id: newID()}, req.Source, req.Flags)
+}
+
+func (dm *DockerManager) compileCheck(lang string, caller compileCaller, src Source, flags RunFlags) (*CheckResult, error) {
+	_, err := dm.buildCommand(lang, caller, src, flags)
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) {
+		return compileErr.Result(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CheckResult{Success: true, Diagnostics: []Diagnostic{}}, nil
+}
+
+// Result returns the failed check result of the compile error.
+func (e *CompileError) Result() *CheckResult {
+	diagnostics := e.Diagnostics
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	return &CheckResult{Output: e.Output, Diagnostics: diagnostics}
+}
+
+// parseDiagnostics parses the output of the compiler of lang. Lines that are
+// not diagnostics, like source excerpts, are skipped or folded into the
+// message they belong to.
+func parseDiagnostics(lang, output string) []Diagnostic {
+	switch lang {
+	case "c", "cpp":
+		return parseGccDiagnostics(output)
+	case "java":
+		return parseJavacDiagnostics(output)
+	case "ts":
+		return parseTscDiagnostics(output)
+	}
+	return nil
+}
+
+func parseGccDiagnostics(output string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := gccDiagnostic.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		severity := m[4]
+		if severity == "fatal error" {
+			severity = SEVERITY_ERROR
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Column:   atoi(m[3]),
+			Severity: severity,
+			Message:  m[5],
+			Code:     m[6],
+		})
+	}
+	return diagnostics
+}
+
+// javac prints the source line and a caret under the column after each
+// diagnostic.
+func parseJavacDiagnostics(output string) []Diagnostic {
+	var diagnostics []Diagnostic
+	var current *Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		if m := javacDiagnostic.FindStringSubmatch(line); m != nil {
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     m[1],
+				Line:     atoi(m[2]),
+				Severity: m[3],
+				Code:     m[4],
+				Message:  m[5],
+			})
+			current = &diagnostics[len(diagnostics)-1]
+			continue
+		}
+		if current == nil || current.Column > 0 {
+			continue
+		}
+		if trimmed := strings.TrimSpace(line); trimmed == "^" {
+			current.Column = strings.Index(line, "^") + 1
+		}
+	}
+	return diagnostics
+}
+
+// tsc continues long messages on indented lines.
+func parseTscDiagnostics(output string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		if m := tscDiagnostic.FindStringSubmatch(line); m != nil {
+			severity := m[4]
+			if severity == "message" {
+				severity = SEVERITY_NOTE
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     m[1],
+				Line:     atoi(m[2]),
+				Column:   atoi(m[3]),
+				Severity: severity,
+				Code:     m[5],
+				Message:  m[6],
+			})
+			continue
+		}
+		if last := len(diagnostics) - 1; last >= 0 && strings.HasPrefix(line, "  ") {
+			diagnostics[last].Message += "\n" + strings.TrimSpace(line)
+		}
+	}
+	return diagnostics
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,180 @@
+package compiler
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseGccDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Diagnostic
+	}{
+		{
+			name: "error with excerpt",
+			output: "main.c: In function 'main':\n" +
+				"main.c:4:17: error: expected ';' before 'return'\n" +
+				"    4 |     printf(\"hi\")\n" +
+				"      |                 ^\n" +
+				"      |                 ;\n" +
+				"    5 |     return 0;\n" +
+				"      |     ~~~~~~\n",
+			want: []Diagnostic{
+				{File: "main.c", Line: 4, Column: 17, Severity: SEVERITY_ERROR, Message: "expected ';' before 'return'"},
+			},
+		},
+		{
+			name: "warning with flag and note",
+			output: "main.cpp:3:9: warning: unused variable 'x' [-Wunused-variable]\n" +
+				"main.cpp:7:6: note: declared here\n",
+			want: []Diagnostic{
+				{File: "main.cpp", Line: 3, Column: 9, Severity: SEVERITY_WARNING, Message: "unused variable 'x'", Code: "-Wunused-variable"},
+				{File: "main.cpp", Line: 7, Column: 6, Severity: SEVERITY_NOTE, Message: "declared here"},
+			},
+		},
+		{
+			name:   "warning promoted by -Werror",
+			output: "main.c:2:5: error: unused variable 'y' [-Werror=unused-variable]\ncc1: all warnings being treated as errors\n",
+			want: []Diagnostic{
+				{File: "main.c", Line: 2, Column: 5, Severity: SEVERITY_ERROR, Message: "unused variable 'y'", Code: "-Werror=unused-variable"},
+			},
+		},
+		{
+			name:   "fatal error without column",
+			output: "main.c:1: fatal error: nope.h: No such file or directory\ncompilation terminated.\n",
+			want: []Diagnostic{
+				{File: "main.c", Line: 1, Severity: SEVERITY_ERROR, Message: "nope.h: No such file or directory"},
+			},
+		},
+		{
+			name:   "path with directories",
+			output: "src/util/math.c:10:2: error: 'z' undeclared (first use in this function)\n",
+			want: []Diagnostic{
+				{File: "src/util/math.c", Line: 10, Column: 2, Severity: SEVERITY_ERROR, Message: "'z' undeclared (first use in this function)"},
+			},
+		},
+		{
+			name:   "linker errors are not diagnostics",
+			output: "/usr/bin/ld: /tmp/ccX.o: in function `main':\nmain.c:(.text+0x9): undefined reference to `foo'\ncollect2: error: ld returned 1 exit status\n",
+			want:   nil,
+		},
+		{
+			name:   "empty",
+			output: "",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseGccDiagnostics(tt.output); !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJavacDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Diagnostic
+	}{
+		{
+			name: "error with caret",
+			output: "Main.java:3: error: ';' expected\n" +
+				"        System.out.println(\"hi\")\n" +
+				"                                ^\n" +
+				"1 error\n",
+			want: []Diagnostic{
+				{File: "Main.java", Line: 3, Column: 33, Severity: SEVERITY_ERROR, Message: "';' expected"},
+			},
+		},
+		{
+			name: "lint warning and error in a package",
+			output: "app/Util.java:5: warning: [deprecation] Integer(int) in Integer has been deprecated\n" +
+				"        Integer i = new Integer(1);\n" +
+				"                    ^\n" +
+				"app/Main.java:9: error: cannot find symbol\n" +
+				"        foo();\n" +
+				"        ^\n" +
+				"  symbol:   method foo()\n" +
+				"  location: class Main\n" +
+				"1 error\n1 warning\n",
+			want: []Diagnostic{
+				{File: "app/Util.java", Line: 5, Column: 21, Severity: SEVERITY_WARNING, Code: "deprecation", Message: "Integer(int) in Integer has been deprecated"},
+				{File: "app/Main.java", Line: 9, Column: 9, Severity: SEVERITY_ERROR, Message: "cannot find symbol"},
+			},
+		},
+		{
+			name:   "without excerpt",
+			output: "Main.java:1: error: class Foo is public, should be declared in a file named Foo.java\n",
+			want: []Diagnostic{
+				{File: "Main.java", Line: 1, Severity: SEVERITY_ERROR, Message: "class Foo is public, should be declared in a file named Foo.java"},
+			},
+		},
+		{
+			name:   "not a diagnostic",
+			output: "error: no source files\n",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseJavacDiagnostics(tt.output); !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTscDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Diagnostic
+	}{
+		{
+			name:   "error",
+			output: "main.ts(3,5): error TS2322: Type 'string' is not assignable to type 'number'.\n",
+			want: []Diagnostic{
+				{File: "main.ts", Line: 3, Column: 5, Severity: SEVERITY_ERROR, Code: "TS2322", Message: "Type 'string' is not assignable to type 'number'."},
+			},
+		},
+		{
+			name: "continued message",
+			output: "src/a.ts(10,12): error TS2345: Argument of type '{ a: string; }' is not assignable to parameter of type 'B'.\n" +
+				"  Property 'b' is missing in type '{ a: string; }' but required in type 'B'.\n" +
+				"main.ts(1,1): message TS6133: 'x' is declared but its value is never read.\n",
+			want: []Diagnostic{
+				{
+					File: "src/a.ts", Line: 10, Column: 12, Severity: SEVERITY_ERROR, Code: "TS2345",
+					Message: "Argument of type '{ a: string; }' is not assignable to parameter of type 'B'.\n" +
+						"Property 'b' is missing in type '{ a: string; }' but required in type 'B'.",
+				},
+				{File: "main.ts", Line: 1, Column: 1, Severity: SEVERITY_NOTE, Code: "TS6133", Message: "'x' is declared but its value is never read."},
+			},
+		},
+		{
+			name:   "indented line before any diagnostic",
+			output: "  stray\nerror TS5023: Unknown compiler option '--foo'.\n",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTscDiagnostics(tt.output); !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDiagnosticsLanguages(t *testing.T) {
+	if got := parseDiagnostics("py", "main.c:1:1: error: x"); got != nil {
+		t.Errorf("interpreted languages have no diagnostics, got %+v", got)
+	}
+	if got := parseDiagnostics("cpp", "main.cpp:1:1: error: x"); len(got) != 1 {
+		t.Errorf("cpp uses the gcc parser, got %+v", got)
+	}
+}
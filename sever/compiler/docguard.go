@@ -59,6 +59,12 @@ func (dm *DockerManager) checkAndUpdateResources() {
 	maps.Copy(resuableContainers, dm.reusableContainers)
 	maps.Copy(filledContainers, dm.filledContainers)
 	maps.Copy(containerResources, dm.containerResources)
+	// Warm containers are idle on purpose
+	for containerID := range containerResources {
+		if dm.isWarm(containerID) {
+			delete(containerResources, containerID)
+		}
+	}
 
 	dm.mu.Unlock()
 	log.Print("unlock by checkAndUpdateResources copy: ", time.Since(start))
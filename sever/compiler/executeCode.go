@@ -1,227 +1,335 @@
 package compiler
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/docker/docker/api/types/container"
-	"github.com/gofiber/websocket/v2"
+	"path/filepath"
 )
 
-func (dm *DockerManager) RunLiveCode(lang, containerID string, conn *websocket.Conn) error {
-	ctx := context.Background()
+// RunLiveCode is the run loop of a session, it compiles and runs every run
+// message until the session is closed.
+func (dm *DockerManager) RunLiveCode(s *Session) error {
+	lang := s.Lang
 	opt, ok := LangImages[lang]
 	if !ok {
 		return fmt.Errorf("unsupported language: %s", lang)
 	}
 
-	_, msg, err := conn.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("failed to read message: %w", err)
-	}
-
-	code := string(msg)
-
-	var waitForMsg bool
+	var next *ClientMessage
+	first := true
 
 	for {
-		if waitForMsg {
-			typ, msg, err := conn.ReadMessage()
-			if err != nil || typ == websocket.CloseMessage {
-				dm.DecreaseUser(containerID)
-				return fmt.Errorf("failed to read message: %w", err)
+		msg := next
+		next = nil
+		if msg == nil {
+			select {
+			case in := <-s.inbox:
+				msg = &in
+			case <-s.Done():
+				return ErrSessionClosed
 			}
-			code = string(msg)
 		}
 
-		if !strings.HasPrefix(code, "CODE:") {
-			return fmt.Errorf("first message must be CODE")
+		if msg.Type == MSG_CHECK {
+			first = false
+			dm.checkLive(s, msg)
+			continue
 		}
-		tcode := strings.TrimPrefix(code, "CODE:")
-
-		if lang == "c" {
-			tcode = "#include <stdio.h>\n" +
-				"#ifdef __unix__\n" +
-				"#include <unistd.h>\n" +
-				"#endif\n" +
-				"void __attribute__((constructor)) initIO(void) {\n" +
-				"    setvbuf(stdout, NULL, _IONBF, 0);\n" +
-				"    setvbuf(stderr, NULL, _IONBF, 0);\n" +
-				"}\n" + tcode
+		if msg.Type != MSG_RUN {
+			if first && s.Protocol() == PROTOCOL_LEGACY {
+				return fmt.Errorf("first message must be CODE")
+			}
+			s.SendError(msg.RunID, fmt.Errorf("no program running, expected a %s message", MSG_RUN))
+			continue
 		}
+		first = false
 
-		// Setup exec instance
-		execConfig := container.ExecOptions{
-			AttachStdin:  true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Tty:          false,
-			Cmd:          opt.ExecCmd(tcode),
-			User:         "nobody",
-			Env:          opt.Env,
-			WorkingDir:   "/tmp",
-			Privileged:   false,
+		var run RunPayload
+		if err := msg.Decode(&run); err != nil {
+			s.SendError(msg.RunID, err)
+			continue
+		}
+		if err := run.Callback.Validate(); err != nil {
+			s.SendError(msg.RunID, err)
+			continue
+		}
+		if err := run.Source.Validate(lang); err != nil {
+			s.SendError(msg.RunID, err)
+			continue
+		}
+		if err := run.Flags.Validate(lang); err != nil {
+			s.SendError(msg.RunID, err)
+			continue
 		}
 
-		if opt.IsCompiled {
-			fileName := opt.FileName(containerID)
+		runID := msg.RunID
+		if runID == "" {
+			runID = newID()
+		}
 
-			if err := os.WriteFile(CODE_FILES_DIR+"/"+fileName, []byte(tcode), 0644); err != nil {
-				log.Printf("failed to write file: %v", err)
+		cmd, err := dm.buildCommand(lang, s.compileCaller(runID), run.Source, run.Flags)
+		var compileErr *CompileError
+		if errors.As(err, &compileErr) {
+			s.Send(MSG_DIAGNOSTICS, runID, *compileErr.Result())
+		}
+		if err != nil {
+			s.SendError(runID, err)
+			continue
+		}
+		cmd = append(cmd, run.Args...)
 
-				if err := conn.WriteMessage(websocket.TextMessage, []byte("error: "+err.Error())); err != nil {
-					return fmt.Errorf("failed to send message: %w", err)
-				}
-				waitForMsg = true
-				continue
-			}
+		spec := execSpec{
+			runID:    runID,
+			cmd:      cmd,
+			tty:      run.Tty,
+			size:     ResizePayload{Cols: run.Cols, Rows: run.Rows},
+			limits:   run.Limits,
+			spill:    run.SpillOutput,
+			callback: run.Callback,
+		}
+		spec.applyLimits(opt)
 
-			if opt.RunOnHost != nil {
-				cmd := opt.RunOnHost(CODE_FILES_DIR + "/" + fileName)
-				if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
-					log.Printf("failed to run command on host: %v", err)
+		next, err = dm.runExec(s, opt, spec)
+		if err != nil {
+			return err
+		}
+	}
+}
 
-					if err := conn.WriteMessage(websocket.TextMessage, []byte("error: "+string(out))); err != nil {
-						return fmt.Errorf("failed to send message: %w", err)
-					}
-					waitForMsg = true
-					continue
-				}
+// checkLive answers a check message with the diagnostics of the code.
+func (dm *DockerManager) checkLive(s *Session, msg *ClientMessage) {
+	var check CheckPayload
+	if err := msg.Decode(&check); err != nil {
+		s.SendError(msg.RunID, err)
+		return
+	}
+	if !LangImages[s.Lang].IsCompiled {
+		s.SendError(msg.RunID, fmt.Errorf("check is only supported for compiled languages"))
+		return
+	}
 
-				if lang == "java" && len(cmd) > 2 {
-					fileName = strings.TrimPrefix(cmd[2], CONTAINER_COMPILED_FILES+"/")
-				}
-			} else {
-				return fmt.Errorf("no Host command provided")
-			}
+	if err := check.Source.Validate(s.Lang); err != nil {
+		s.SendError(msg.RunID, err)
+		return
+	}
+	if err := check.Flags.Validate(s.Lang); err != nil {
+		s.SendError(msg.RunID, err)
+		return
+	}
 
-			if lang == "ts" {
-				fileName = fileName[:len(fileName)-3] + ".js"
-			}
-			if lang == "c" {
-				fileName = fileName[:len(fileName)-2] + ".out"
-			}
-			if lang == "cpp" {
-				fileName = fileName[:len(fileName)-4] + ".out"
-			}
+	result, err := dm.compileCheck(s.Lang, s.compileCaller(msg.RunID), check.Source, check.Flags)
+	if err != nil {
+		s.SendError(msg.RunID, err)
+		return
+	}
+	s.Send(MSG_DIAGNOSTICS, msg.RunID, *result)
+}
 
-			execConfig.Cmd = opt.ExecCmd(CONTAINER_COMPILED_FILES + "/" + fileName)
-		}
+// CompileError carries the compiler output of a failed build.
+type CompileError struct {
+	Output      string
+	Diagnostics []Diagnostic
+}
 
-		execResp, err := dm.cli.ContainerExecCreate(ctx, containerID, execConfig)
-		if err != nil {
-			if err := conn.WriteMessage(websocket.TextMessage, []byte("error: "+err.Error())); err != nil {
-				return fmt.Errorf("failed to send message: %w", err)
-			}
-			waitForMsg = true
-			continue
+func (e *CompileError) Error() string {
+	return e.Output
+}
+
+// buildCommand prepares the code for execution, installing its dependencies
+// and compiling it in the sandbox for compiled languages, and returns the
+// command to exec in the container. The source and flags must have been
+// validated.
+func (dm *DockerManager) buildCommand(lang string, caller compileCaller, src Source, flags RunFlags) ([]string, error) {
+	deps, err := src.dependencies(lang)
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	if len(deps) > 0 {
+		if env, err = dm.installPackages(lang, caller, deps); err != nil {
+			return nil, err
 		}
+	}
 
-		ctx, cancel := context.WithCancel(ctx)
-		defer cancel()
+	cmd, err := dm.buildProgram(lang, caller, src, flags)
+	if err != nil || env == nil {
+		return cmd, err
+	}
+	// The program replaces env, so its pid stays the one the exec reports
+	return append(append([]string{"env"}, env...), cmd...), nil
+}
 
-		hijackedResp, err := dm.cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{Tty: false})
-		if err != nil {
-			if err := conn.WriteMessage(websocket.TextMessage, []byte("error: "+err.Error())); err != nil {
-				return fmt.Errorf("failed to send message: %w", err)
-			}
-			waitForMsg = true
-			continue
+// buildProgram builds the command of the program itself.
+func (dm *DockerManager) buildProgram(lang string, caller compileCaller, src Source, flags RunFlags) ([]string, error) {
+	if lang == "java" && !src.isProject() {
+		src = src.asJavaProject()
+	}
+	if src.isProject() {
+		return dm.buildProject(lang, caller, src, flags)
+	}
+
+	opt := LangImages[lang]
+	code := opt.Preamble + src.Code
+
+	if !opt.IsCompiled {
+		return withRuntimeFlags(opt.ExecCmd(code), opt, flags.Runtime), nil
+	}
+
+	if opt.CompileCmd == nil {
+		return nil, fmt.Errorf("no compile command provided")
+	}
+
+	key := dm.compileKey(lang, flags, map[string]string{opt.SourceName: code}, "code")
+	if run, ok := dm.compileCache.Get(key); ok {
+		return withRuntimeFlags(run, opt, flags.Runtime), nil
+	}
+
+	run, err := dm.compiles.Do(lang, key, caller, func() ([]string, error) {
+		return dm.compileCode(lang, code, flags, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withRuntimeFlags(run, opt, flags.Runtime), nil
+}
+
+// compileCode compiles a single file and caches the build under key. It
+// returns the command that runs it, before runtime flags.
+func (dm *DockerManager) compileCode(lang, code string, flags RunFlags, key string) ([]string, error) {
+	opt := LangImages[lang]
+
+	dir, err := newBuildDir("build")
+	if err != nil {
+		return nil, err
+	}
+	// Caller ids can be session tokens, and run containers see file names
+	fileName := opt.FileName(newID())
+	if err := os.WriteFile(filepath.Join(dir, fileName), []byte(code), 0644); err != nil {
+		log.Printf("failed to write file: %v", err)
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	cmd := opt.CompileCmd(filepath.Join(dir, fileName))
+	cmd = append(cmd, expandFlags(opt.CompileFlags, flags.Compile)...)
+	out, ok, err := dm.compileInSandbox(opt, dir, cmd)
+	if err != nil || !ok {
+		os.RemoveAll(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Printf("failed to compile %s code", lang)
+		rewriter := newSourceRewriter(opt)
+		return nil, &CompileError{
+			Output:      rewriter.RewriteCompileOutput(out),
+			Diagnostics: rewriter.RewriteDiagnostics(parseDiagnostics(lang, out)),
 		}
+	}
+
+	if lang == "ts" {
+		fileName = fileName[:len(fileName)-3] + ".js"
+	}
+	if lang == "c" {
+		fileName = fileName[:len(fileName)-2] + ".out"
+	}
+	if lang == "cpp" {
+		fileName = fileName[:len(fileName)-4] + ".out"
+	}
+
+	run := opt.ExecCmd(filepath.Join(dir, fileName))
+	dm.compileCache.Put(key, dir, run)
+	return run, nil
+}
 
-		waitForMsg = false
-
-		go func() {
-			EXEC_TIMEOUT := 5 * time.Minute
-			ticker := time.NewTicker(500 * time.Millisecond)
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
-					inspect, err := dm.cli.ContainerExecInspect(ctx, execResp.ID)
-					if err != nil || !inspect.Running {
-						cancel()
-						conn.WriteMessage(websocket.TextMessage, []byte("EXEC_TERMINATED"))
-						return
-					}
-				case <-time.After(EXEC_TIMEOUT):
-					cancel()
-					conn.WriteMessage(websocket.TextMessage, []byte("EXEC_TIMEOUT"))
-					return
+// runExec runs one program until it exits or the client stops it, then sends
+// the run summary. A run message received meanwhile is returned so the caller
+// can start it next.
+func (dm *DockerManager) runExec(s *Session, opt LangOptions, spec execSpec) (*ClientMessage, error) {
+	runID, containerID := spec.runID, s.ContainerID
+
+	e, err := dm.startExec(containerID, opt, spec, s, s.waitForWindow)
+	if err != nil {
+		s.SendError(runID, err)
+		return nil, nil
+	}
+	defer e.cancel()
+	ctx, run, hijackedResp := e.ctx, e.run, e.hijackedResp
+
+	var next *ClientMessage
+	var closed bool
+
+loop:
+	for {
+		select {
+		case <-e.outputDone:
+			break loop
+		case <-ctx.Done():
+			break loop
+		case <-s.Done():
+			run.setReason(EXIT_REASON_DISCONNECT)
+			closed = true
+			break loop
+		case in := <-s.inbox:
+			switch in.Type {
+			case MSG_RUN:
+				run.setReason(EXIT_REASON_USER_STOP)
+				next = &in
+				break loop
+			case MSG_STOP:
+				run.setReason(EXIT_REASON_USER_STOP)
+				break loop
+			case MSG_STDIN:
+				var stdin StdinPayload
+				if err := in.Decode(&stdin); err != nil {
+					s.SendError(runID, err)
+					continue
 				}
-			}
-		}()
-
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		go func() {
-			defer wg.Done()
-			buffer := make([]byte, 4096)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					n, err := hijackedResp.Reader.Read(buffer)
-					if err != nil {
-						if err != io.EOF {
-							log.Printf("read error: %v", err)
-						}
-						return
-					}
-					if n > 0 {
-						if err := conn.WriteMessage(websocket.TextMessage, buffer[:n]); err != nil {
-							return
-						}
-					}
+				hijackedResp.Conn.Write([]byte(stdin.Data))
+			case MSG_RESIZE:
+				var size ResizePayload
+				if err := in.Decode(&size); err != nil {
+					s.SendError(runID, err)
+					continue
 				}
-			}
-		}()
-
-		go func(code *string) {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					typ, msg, err := conn.ReadMessage()
-					if err != nil || typ == websocket.CloseMessage {
-						dm.DecreaseUser(containerID)
-						cancel()
-						return
-					}
-
-					// Handle new CODE message
-					if strMsg := string(msg); strings.HasPrefix(strMsg, "CODE:") {
-						*code = strMsg
-						cancel()
-						return
-					}
-
-					if strMsg := string(msg); strMsg == "STOP" {
-						cancel()
-						return
-					}
-
-					// Forward input
-					hijackedResp.Conn.Write(append(msg, '\n'))
+				if !spec.tty {
+					s.SendError(runID, fmt.Errorf("resize needs a run started with tty"))
+					continue
+				}
+				if err := dm.resizeExec(ctx, run, size); err != nil {
+					s.SendError(runID, err)
 				}
+			case MSG_SIGNAL:
+				var sig SignalPayload
+				if err := in.Decode(&sig); err != nil {
+					s.SendError(runID, err)
+					continue
+				}
+				if err := dm.forwardSignal(containerID, run, spec, hijackedResp, sig.Signal); err != nil {
+					s.SendError(runID, err)
+				}
+			case MSG_EOF:
+				if err := closeStdin(spec, hijackedResp); err != nil {
+					s.SendError(runID, err)
+				}
+			case MSG_CHECK:
+				// Compiling takes a while, input must keep flowing meanwhile
+				go dm.checkLive(s, &in)
+			default:
+				s.SendError(in.RunID, fmt.Errorf("unknown message type %s", in.Type))
 			}
-		}(&code)
+		}
+	}
 
-		wg.Wait()
-		hijackedResp.Close()
+	summary := dm.finishExec(e, s)
+	dm.webhooks.Notify(spec.callback, EVENT_RUN_COMPLETED, runID, summary)
+	s.Send(MSG_EXIT, runID, summary)
+	if closed {
+		return nil, ErrSessionClosed
 	}
+
+	return next, nil
 }
@@ -0,0 +1,56 @@
+package compiler
+
+import "fmt"
+
+// RunFlags are the compiler and runtime flags a run asks for. Only flags
+// from the allowlists of the language are accepted.
+type RunFlags struct {
+	Compile []string `json:"compile,omitempty"`
+	Runtime []string `json:"runtime,omitempty"`
+}
+
+func (f RunFlags) Validate(lang string) error {
+	opt, ok := LangImages[lang]
+	if !ok {
+		return fmt.Errorf("unsupported language: %s", lang)
+	}
+	for _, flag := range f.Compile {
+		if _, ok := opt.CompileFlags[flag]; !ok {
+			return fmt.Errorf("compiler flag %q is not allowed for %s", flag, lang)
+		}
+	}
+	for _, flag := range f.Runtime {
+		if _, ok := opt.RuntimeFlags[flag]; !ok {
+			return fmt.Errorf("runtime flag %q is not allowed for %s", flag, lang)
+		}
+	}
+	return nil
+}
+
+// expandFlags returns the arguments the allowlisted flags stand for.
+func expandFlags(allowed map[string][]string, flags []string) []string {
+	var args []string
+	for _, flag := range flags {
+		args = append(args, allowed[flag]...)
+	}
+	return args
+}
+
+// withRuntimeFlags puts the runtime flags right after the interpreter.
+func withRuntimeFlags(cmd []string, opt LangOptions, flags []string) []string {
+	args := expandFlags(opt.RuntimeFlags, flags)
+	if len(args) == 0 || len(cmd) == 0 {
+		return cmd
+	}
+	out := append([]string{cmd[0]}, args...)
+	return append(out, cmd[1:]...)
+}
+
+// sameFlags allowlists flags that are passed on as they are.
+func sameFlags(flags ...string) map[string][]string {
+	allowed := make(map[string][]string, len(flags))
+	for _, flag := range flags {
+		allowed[flag] = []string{flag}
+	}
+	return allowed
+}
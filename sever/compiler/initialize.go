@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
@@ -22,13 +22,18 @@ func NewDockerManager() (*DockerManager, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	imageIDs := make(map[string]string)
 	for _, opts := range LangImages {
-		_, err := cli.ImageInspect(ctx, opts.Image)
-		if err != nil {
-			if _, err := cli.ImagePull(ctx, opts.Image, image.PullOptions{}); err != nil {
+		for _, name := range []string{opts.Image, opts.CompileImage} {
+			if name == "" {
+				continue
+			}
+			id, err := ensureImage(ctx, cli, name)
+			if err != nil {
 				cancel()
-				return nil, fmt.Errorf("failed to pull image: %w", err)
+				return nil, err
 			}
+			imageIDs[name] = id
 		}
 
 		for _, m := range opts.Mounts {
@@ -55,20 +60,63 @@ func NewDockerManager() (*DockerManager, error) {
 				return nil, fmt.Errorf("failed to create directory: %w", err)
 			}
 		}
+		if _, err := os.Stat(JUDGE_FILES); os.IsNotExist(err) {
+			if err := os.MkdirAll(JUDGE_FILES, 0755); err != nil {
+				cancel()
+				return nil, fmt.Errorf("failed to create directory: %w", err)
+			}
+		}
+		if _, err := os.Stat(ARTIFACTS_DIR); os.IsNotExist(err) {
+			if err := os.MkdirAll(ARTIFACTS_DIR, 0755); err != nil {
+				cancel()
+				return nil, fmt.Errorf("failed to create directory: %w", err)
+			}
+		}
 
 	}
+	// Every run container mounts the builds of all users. Without read access
+	// they still reach the files they were told about but cannot list the rest
+	if err := os.Chmod(COMPILED_FILES, 0711); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to restrict directory: %w", err)
+	}
+	if err := createMirrorDirs(); err != nil {
+		cancel()
+		return nil, err
+	}
 	return &DockerManager{
 		cli:                cli,
 		reusableContainers: make(map[string]map[string]int),
 		filledContainers:   make(map[string]map[string]int),
 		runningContainers:  map[string]int{},
 		containerResources: make(map[string]ContainerResources),
+		warmContainers:     make(map[string][]string),
+		warming:            make(map[string]int),
+		sessions:           make(map[string]*Session),
+		webhooks:           NewWebhookDispatcher(),
+		compileCache:       NewCompileCache(COMPILE_CACHE_BYTES),
+		compiles:           newCompileScheduler(),
+		imageIDs:           imageIDs,
 		ctx:                ctx,
 		cancel:             cancel,
 	}, nil
 }
 
+// CreateContainer starts a container for lang and registers it. Must be
+// called with dm.mu held.
 func (dm *DockerManager) CreateContainer(lang string) (string, error) {
+	id, err := dm.startContainer(lang)
+	if err != nil {
+		return "", err
+	}
+	dm.registerContainer(lang, id)
+	return id, nil
+}
+
+// startContainer creates and starts a container for lang without touching
+// the bookkeeping, so it does not need dm.mu. Extra mounts are for
+// containers that are never shared, see startJudgeProgram.
+func (dm *DockerManager) startContainer(lang string, extra ...mount.Mount) (string, error) {
 	ctx := context.Background()
 	opt, ok := LangImages[lang]
 	if !ok {
@@ -117,7 +165,7 @@ func (dm *DockerManager) CreateContainer(lang string) (string, error) {
 			},
 		},
 
-		Mounts: opt.Mounts,
+		Mounts: append(slices.Clone(opt.Mounts), extra...),
 		RestartPolicy: container.RestartPolicy{
 			Name:              "always",
 			MaximumRetryCount: 0,
@@ -133,6 +181,13 @@ func (dm *DockerManager) CreateContainer(lang string) (string, error) {
 		return "", fmt.Errorf("failed to start container: %w", err)
 	}
 
+	return resp.ID, nil
+}
+
+// registerContainer must be called with dm.mu held.
+func (dm *DockerManager) registerContainer(lang, id string) {
+	opt := LangImages[lang]
+
 	dm.runningContainers[lang]++
 	if dm.reusableContainers[lang] == nil {
 		dm.reusableContainers[lang] = make(map[string]int)
@@ -141,12 +196,10 @@ func (dm *DockerManager) CreateContainer(lang string) (string, error) {
 		dm.filledContainers[lang] = make(map[string]int)
 	}
 
-	dm.containerResources[resp.ID] = ContainerResources{
+	dm.containerResources[id] = ContainerResources{
 		CurrentMemory: opt.MinMem,
 		CurrentCPU:    opt.MinCpu,
 	}
-
-	return resp.ID, nil
 }
 
 func (dm *DockerManager) RemoveContainer(containerID string, lang string) error {
@@ -176,6 +229,11 @@ func (dm *DockerManager) RemoveContainer(containerID string, lang string) error
 	})
 }
 
+func (dm *DockerManager) Webhooks() *WebhookDispatcher {
+	return dm.webhooks
+}
+
 func (dm *DockerManager) Shutdown() {
 	dm.cancel()
+	dm.removeWarmContainers()
 }
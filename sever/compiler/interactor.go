@@ -0,0 +1,223 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	INTERACTOR_WALL_GRACE = 2 * time.Second
+	INTERACTOR_EXIT_GRACE = time.Second
+	TRANSCRIPT_MAX_BYTES  = 64 * 1024
+)
+
+const (
+	TRANSCRIPT_USER       = "user"
+	TRANSCRIPT_INTERACTOR = "interactor"
+)
+
+// Interactor converses with the submission for interactive problems. It is
+// run as `<program> <input> <expected>`, its stdout is the stdin of the
+// submission and the other way round. It exits like a Checker and reports
+// its message on stderr, since stdout belongs to the conversation.
+type Interactor struct {
+	Language string    `json:"language"`
+	Code     string    `json:"code"`
+	Limits   RunLimits `json:"limits"`
+}
+
+type TranscriptEntry struct {
+	From string `json:"from"`
+	Data string `json:"data"`
+}
+
+func (it *Interactor) Validate() error {
+	if it == nil {
+		return nil
+	}
+	if _, ok := LangImages[it.Language]; !ok {
+		return fmt.Errorf("unsupported interactor language: %s", it.Language)
+	}
+	if it.Code == "" {
+		return errors.New("interactor code is required")
+	}
+	return nil
+}
+
+// transcript records the conversation in order, up to TRANSCRIPT_MAX_BYTES.
+type transcript struct {
+	mu        sync.Mutex
+	entries   []TranscriptEntry
+	bytes     int
+	truncated bool
+}
+
+func (t *transcript) add(from string, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := TRANSCRIPT_MAX_BYTES - t.bytes; len(data) > n {
+		data = data[:n]
+		t.truncated = true
+	}
+	if len(data) == 0 {
+		return
+	}
+	t.bytes += len(data)
+
+	if last := len(t.entries) - 1; last >= 0 && t.entries[last].From == from {
+		t.entries[last].Data += string(data)
+		return
+	}
+	t.entries = append(t.entries, TranscriptEntry{From: from, Data: string(data)})
+}
+
+// interactionSender forwards what one side writes on stdout to the stdin of
+// the other side. dst is only set once both execs are up.
+type interactionSender struct {
+	from       string
+	out        *outputCollector
+	transcript *transcript
+	ready      chan struct{}
+	dst        io.Writer
+}
+
+func (s *interactionSender) Send(msgType, runID string, payload any) error {
+	p, ok := payload.(OutputPayload)
+	if !ok {
+		return nil
+	}
+	s.out.Send(msgType, runID, payload)
+	if p.Stream == STREAM_STDERR {
+		return nil
+	}
+
+	data := p.Bytes()
+	s.transcript.add(s.from, data)
+
+	<-s.ready
+	if s.dst != nil {
+		// The other side may be gone already, what it missed no longer matters
+		s.dst.Write(data)
+	}
+	return nil
+}
+
+// interact runs one case of an interactive problem with the submission in
+// its container and the interactor in its own, the only one that sees the
+// files of the case.
+func (dm *DockerManager) interact(containerID string, opt LangOptions, spec execSpec, it *judgeProgram, tc TestCase) (CaseResult, error) {
+	dir, paths, err := it.writeFiles(
+		judgeFile{"input", []byte(tc.Stdin)},
+		judgeFile{"expected", []byte(tc.Expected)},
+	)
+	if err != nil {
+		return CaseResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	// The interactor waits on the submission, so it gets a bit more wall time
+	// than the submission and no more
+	limits := it.limits
+	if limits.WallTimeMs <= 0 {
+		limits.WallTimeMs = (spec.wallLimit + INTERACTOR_WALL_GRACE).Milliseconds()
+	}
+	itSpec := execSpec{
+		runID:  newID(),
+		cmd:    append(append([]string(nil), it.cmd...), paths...),
+		limits: limits,
+	}
+	itSpec.applyLimits(it.opt)
+	itSpec.wallLimit = min(itSpec.wallLimit, spec.wallLimit+INTERACTOR_WALL_GRACE)
+
+	tr := &transcript{}
+	ready := make(chan struct{})
+	userOut := &interactionSender{from: TRANSCRIPT_USER, out: &outputCollector{}, transcript: tr, ready: ready}
+	itOut := &interactionSender{from: TRANSCRIPT_INTERACTOR, out: &outputCollector{}, transcript: tr, ready: ready}
+
+	userExec, err := dm.startExec(containerID, opt, spec, userOut, nil)
+	if err != nil {
+		close(ready)
+		return CaseResult{}, err
+	}
+	itExec, err := dm.startExec(it.containerID, it.opt, itSpec, itOut, nil)
+	if err != nil {
+		close(ready)
+		userExec.run.setReason(EXIT_REASON_USER_STOP)
+		dm.finishExec(userExec, userOut)
+		return CaseResult{}, err
+	}
+	userOut.dst = itExec.hijackedResp.Conn
+	itOut.dst = userExec.hijackedResp.Conn
+	close(ready)
+
+	var itSummary RunSummary
+	itDone := make(chan struct{})
+	go func() {
+		defer close(itDone)
+		select {
+		case <-itExec.outputDone:
+		case <-itExec.ctx.Done():
+		}
+		itSummary = dm.finishExec(itExec, itOut)
+		userExec.hijackedResp.CloseWrite()
+	}()
+
+	// Once the interactor is done the submission only gets a moment to exit
+	select {
+	case <-userExec.outputDone:
+	case <-userExec.ctx.Done():
+	case <-itDone:
+		select {
+		case <-userExec.outputDone:
+		case <-userExec.ctx.Done():
+		case <-time.After(INTERACTOR_EXIT_GRACE):
+			userExec.run.setReason(EXIT_REASON_TIMEOUT)
+		}
+	}
+	userSummary := dm.finishExec(userExec, userOut)
+	itExec.hijackedResp.CloseWrite()
+	<-itDone
+
+	user := ExecuteResult{RunID: spec.runID, RunSummary: userSummary}
+	user.Stdout, user.Stderr, user.Encoding = userOut.out.contents()
+
+	itResult := ExecuteResult{RunSummary: itSummary}
+	itResult.Stdout, itResult.Stderr, itResult.Encoding = itOut.out.contents()
+	_, message, err := itResult.outputBytes()
+	if err != nil {
+		message = nil
+	}
+	verdict := interactionVerdict(userSummary, judgeVerdict(itSummary, message, "interactor"))
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return CaseResult{
+		Verdict:             verdict.verdict,
+		Score:               verdict.score,
+		Message:             verdict.message,
+		Transcript:          tr.entries,
+		TranscriptTruncated: tr.truncated,
+		Interactor:          &itSummary,
+		ExecuteResult:       user,
+	}, nil
+}
+
+// interactionVerdict lets resource limits of the submission win, then a
+// rejection by the interactor, since a crash of the submission is often
+// just the interactor hanging up on it.
+func interactionVerdict(user RunSummary, judged checkResult) checkResult {
+	switch verdict := runVerdict(user); verdict {
+	case VERDICT_TIME_LIMIT, VERDICT_MEMORY_LIMIT, VERDICT_OUTPUT_LIMIT:
+		return checkResult{verdict: verdict}
+	case VERDICT_RUNTIME:
+		if judged.verdict == VERDICT_ACCEPTED || judged.verdict == VERDICT_PARTIAL {
+			return checkResult{verdict: verdict}
+		}
+	}
+	return judged
+}
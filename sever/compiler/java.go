@@ -0,0 +1,193 @@
+package compiler
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var (
+	javaPackage   = regexp.MustCompile(`\bpackage\s+([\w.]+)\s*;`)
+	javaMainClass = regexp.MustCompile(`^[A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*$`)
+	// A class declaration, a main method with its modifiers or a brace, in
+	// source order
+	javaToken = regexp.MustCompile(`\b(public\s+)?(?:(?:abstract|final|static|sealed|strictfp)\s+)*(?:class|interface|enum|record)\s+([A-Za-z_$][\w$]*)` +
+		`|\b((?:(?:public|protected|private|static|final|synchronized|strictfp)\s+)+)void\s+main\s*\(|[{}]`)
+)
+
+// javaSource is what the file name and the class to run depend on.
+type javaSource struct {
+	pkg         string
+	publicClass string
+	mainClasses []string
+}
+
+// parseJavaSource finds the package, the public top-level class and the
+// classes declaring a main method. Nested classes go by their binary name,
+// Outer$Inner, and mains of local classes are left out since they have no
+// name to run them by.
+func parseJavaSource(code string) javaSource {
+	code = stripJavaLiterals(code)
+	var src javaSource
+	if m := javaPackage.FindStringSubmatch(code); m != nil {
+		src.pkg = m[1]
+	}
+
+	type scope struct {
+		class string // empty for local classes
+		depth int
+	}
+	var classes []scope
+	var pending string
+	depth := 0
+	for _, m := range javaToken.FindAllStringSubmatch(code, -1) {
+		switch {
+		case m[0] == "{":
+			depth++
+			if pending != "" {
+				class := pending
+				if n := len(classes); n > 0 {
+					// Member classes open right in the body of the outer one
+					if outer := classes[n-1]; outer.class != "" && outer.depth == depth-1 {
+						class = outer.class + "$" + pending
+					} else {
+						class = ""
+					}
+				} else if depth != 1 {
+					class = ""
+				}
+				classes = append(classes, scope{class, depth})
+				pending = ""
+			}
+		case m[0] == "}":
+			if n := len(classes); n > 0 && classes[n-1].depth == depth {
+				classes = classes[:n-1]
+			}
+			depth--
+		case m[2] != "":
+			pending = m[2]
+			if m[1] != "" && depth == 0 && src.publicClass == "" {
+				src.publicClass = m[2]
+			}
+		case slices.Contains(strings.Fields(m[3]), "static"):
+			if n := len(classes); n > 0 && classes[n-1].depth == depth && classes[n-1].class != "" {
+				src.mainClasses = append(src.mainClasses, classes[n-1].class)
+			}
+		}
+	}
+	return src
+}
+
+// fileName is where javac expects the source: named after the public class,
+// under the directories of its package.
+func (src javaSource) fileName() string {
+	name := src.publicClass
+	if name == "" && len(src.mainClasses) > 0 {
+		name, _, _ = strings.Cut(src.mainClasses[0], "$")
+	}
+	if name == "" {
+		name = "Main"
+	}
+	return path.Join(strings.ReplaceAll(src.pkg, ".", "/"), name+".java")
+}
+
+// mainClass is the fully qualified class to run, preferring the public class
+// when it has a main method.
+func (src javaSource) mainClass() string {
+	name := ""
+	for _, class := range src.mainClasses {
+		if class == src.publicClass {
+			name = class
+			break
+		}
+	}
+	if name == "" && len(src.mainClasses) > 0 {
+		name = src.mainClasses[0]
+	}
+	if name == "" {
+		return ""
+	}
+	if src.pkg != "" {
+		return src.pkg + "." + name
+	}
+	return name
+}
+
+// javaProjectMainClass picks the class to run: the override, the class with
+// main in the entrypoint or else the first file declaring one.
+func javaProjectMainClass(files map[string]string, entrypoint, override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	if entrypoint != "" {
+		if class := parseJavaSource(files[entrypoint]).mainClass(); class != "" {
+			return class, nil
+		}
+		return "", errors.New("no main method found in " + entrypoint + ", set main_class")
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if strings.HasSuffix(name, ".java") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if class := parseJavaSource(files[name]).mainClass(); class != "" {
+			return class, nil
+		}
+	}
+	return "", errors.New("no main method found, set main_class")
+}
+
+// stripJavaLiterals blanks out comments, strings and char literals so braces
+// and keywords in them are not mistaken for code.
+func stripJavaLiterals(code string) string {
+	var b strings.Builder
+	b.Grow(len(code))
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case strings.HasPrefix(code[i:], "//"):
+			for i < len(code) && code[i] != '\n' {
+				i++
+			}
+			b.WriteByte('\n')
+		case strings.HasPrefix(code[i:], "/*"):
+			end := strings.Index(code[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 3
+			b.WriteByte(' ')
+		case strings.HasPrefix(code[i:], `"""`):
+			end := strings.Index(code[i+3:], `"""`)
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 5
+			b.WriteString(`""`)
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(code) && code[j] != c && code[j] != '\n' {
+				if code[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			i = j
+			if j < len(code) && code[j] == '\n' {
+				// Unterminated, the line break is still code
+				i--
+			}
+			b.WriteString(`""`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
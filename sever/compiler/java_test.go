@@ -0,0 +1,141 @@
+package compiler
+
+import (
+	"testing"
+)
+
+func TestParseJavaSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      string
+		fileName  string
+		mainClass string
+	}{
+		{
+			name:      "plain main",
+			code:      "public class Main {\n    public static void main(String[] args) {}\n}\n",
+			fileName:  "Main.java",
+			mainClass: "Main",
+		},
+		{
+			name:      "public class with another name",
+			code:      "public class Solution { public static void main(String[] a) {} }",
+			fileName:  "Solution.java",
+			mainClass: "Solution",
+		},
+		{
+			name:      "static before public",
+			code:      "class A { static public void main(String[] a) {} }",
+			fileName:  "A.java",
+			mainClass: "A",
+		},
+		{
+			name:      "final main",
+			code:      "public class A { public static final void main(String... a) {} }",
+			fileName:  "A.java",
+			mainClass: "A",
+		},
+		{
+			name:      "synchronized main",
+			code:      "public class A { public synchronized static void main(String[] a) {} }",
+			fileName:  "A.java",
+			mainClass: "A",
+		},
+		{
+			name:      "instance method named main",
+			code:      "public class A { public void main(String[] a) {} }",
+			fileName:  "A.java",
+			mainClass: "",
+		},
+		{
+			name:      "package",
+			code:      "package com.example.app;\n\nimport java.util.*;\n\npublic class App { public static void main(String[] a) {} }",
+			fileName:  "com/example/app/App.java",
+			mainClass: "com.example.app.App",
+		},
+		{
+			name:      "main in a helper class",
+			code:      "class Helper {}\nclass Runner { public static void main(String[] a) {} }",
+			fileName:  "Runner.java",
+			mainClass: "Runner",
+		},
+		{
+			name:      "public class preferred",
+			code:      "class B { public static void main(String[] a) {} }\npublic class A { public static void main(String[] a) {} }",
+			fileName:  "A.java",
+			mainClass: "A",
+		},
+		{
+			name:      "nested class",
+			code:      "public class Main {\n    static class Inner {\n        public static void main(String[] a) {}\n    }\n}\n",
+			fileName:  "Main.java",
+			mainClass: "Main$Inner",
+		},
+		{
+			name:      "nested class without a public class",
+			code:      "class Outer { interface Mid { class Inner { public static void main(String[] a) {} } } }",
+			fileName:  "Outer.java",
+			mainClass: "Outer$Mid$Inner",
+		},
+		{
+			name: "local class",
+			code: "public class Main {\n    void run() {\n        class Local { static void main(String[] a) {} }\n    }\n" +
+				"    public static void main(String[] a) {}\n}\n",
+			fileName:  "Main.java",
+			mainClass: "Main",
+		},
+		{
+			name:      "main in a method body is not a method",
+			code:      "public class A { void f() { Runnable r = () -> { }; } }",
+			fileName:  "A.java",
+			mainClass: "",
+		},
+		{
+			name:      "keywords in comments and strings",
+			code:      "// public class Fake { public static void main\n/* class X { */\npublic class Real {\n    String s = \"class Y { static void main(\";\n    char c = '{';\n    public static void main(String[] a) {}\n}\n",
+			fileName:  "Real.java",
+			mainClass: "Real",
+		},
+		{
+			name:      "no class",
+			code:      "",
+			fileName:  "Main.java",
+			mainClass: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := parseJavaSource(tt.code)
+			if got := src.fileName(); got != tt.fileName {
+				t.Errorf("fileName() = %q, want %q", got, tt.fileName)
+			}
+			if got := src.mainClass(); got != tt.mainClass {
+				t.Errorf("mainClass() = %q, want %q", got, tt.mainClass)
+			}
+		})
+	}
+}
+
+func TestStripJavaLiterals(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"line comment", "a // {\nb", "a \nb"},
+		{"block comment", "a /* { } */b", "a  b"},
+		{"string", `s = "{ \" }";`, `s = "";`},
+		{"char", `c = '{'; d = '\'';`, `c = ""; d = "";`},
+		{"text block", "s = \"\"\"\n  class X {\n  \"\"\";", `s = "";`},
+		{"unterminated string stops at the line end", "s = \"{\nclass A {}", "s = \"\"\nclass A {}"},
+		{"unterminated comment", "a /* {", "a "},
+		{"code", "class A { }", "class A { }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripJavaLiterals(tt.code); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_WORKERS    = 4
+	JOB_QUEUE_SIZE = 256
+	JOB_RETENTION  = time.Hour
+)
+
+const (
+	JOB_QUEUED    = "queued"
+	JOB_COMPILING = "compiling"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_CANCELLED = "cancelled"
+	JOB_FAILED    = "failed"
+)
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+)
+
+type Job struct {
+	ID      string
+	Request ExecuteRequest
+
+	state      string
+	compileAt  int // place in the compile queue while compiling
+	result     *ExecuteResult
+	err        string
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	out        *outputCollector
+	stop       chan struct{}
+	stopped    bool
+}
+
+// JobStatus is what GET /jobs/:id returns. While the job runs stdout and
+// stderr hold the output so far.
+type JobStatus struct {
+	ID            string         `json:"id"`
+	State         string         `json:"state"`
+	QueuePosition int            `json:"queue_position,omitempty"`
+	Stdout        string         `json:"stdout,omitempty"`
+	Stderr        string         `json:"stderr,omitempty"`
+	Encoding      string         `json:"encoding,omitempty"`
+	Result        *ExecuteResult `json:"result,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	StartedAt     *time.Time     `json:"started_at,omitempty"`
+	FinishedAt    *time.Time     `json:"finished_at,omitempty"`
+}
+
+// JobQueue runs batch jobs on a fixed number of workers so long workloads
+// don't need a connection held open.
+type JobQueue struct {
+	dm      *DockerManager
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*Job
+	pending []*Job
+	closed  bool
+}
+
+func NewJobQueue(dm *DockerManager, workers int) *JobQueue {
+	q := &JobQueue{
+		dm:   dm,
+		jobs: make(map[string]*Job),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	for range workers {
+		go q.worker()
+	}
+	return q
+}
+
+func (q *JobQueue) Submit(req ExecuteRequest) (JobStatus, error) {
+	if err := req.Validate(); err != nil {
+		return JobStatus{}, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= JOB_QUEUE_SIZE {
+		return JobStatus{}, ErrQueueFull
+	}
+
+	job := &Job{
+		ID:        newToken(),
+		Request:   req,
+		state:     JOB_QUEUED,
+		createdAt: time.Now(),
+		out:       &outputCollector{},
+		stop:      make(chan struct{}),
+	}
+	q.jobs[job.ID] = job
+	q.pending = append(q.pending, job)
+	q.cond.Signal()
+
+	return q.status(job), nil
+}
+
+func (q *JobQueue) Get(id string) (JobStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return JobStatus{}, ErrJobNotFound
+	}
+	return q.status(job), nil
+}
+
+// Cancel drops a queued job or stops a running one.
+func (q *JobQueue) Cancel(id string) (JobStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return JobStatus{}, ErrJobNotFound
+	}
+
+	switch job.state {
+	case JOB_QUEUED:
+		for i, pending := range q.pending {
+			if pending == job {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		job.stopped = true
+		close(job.stop)
+		q.finish(job, JOB_CANCELLED, nil, "")
+		q.dm.webhooks.Notify(job.Request.Callback, EVENT_JOB_COMPLETED, job.ID, q.status(job))
+	case JOB_COMPILING, JOB_RUNNING:
+		if !job.stopped {
+			job.stopped = true
+			close(job.stop)
+		}
+	default:
+		return q.status(job), ErrJobFinished
+	}
+
+	return q.status(job), nil
+}
+
+func (q *JobQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		job := q.pending[0]
+		q.pending = q.pending[1:]
+		if job.stopped {
+			q.mu.Unlock()
+			continue
+		}
+		// Claimed under the lock, so a cancel from now on stops the run
+		// instead of finishing the job itself
+		job.state = JOB_COMPILING
+		job.startedAt = time.Now()
+		q.mu.Unlock()
+
+		result, err := q.run(job)
+
+		q.mu.Lock()
+		switch {
+		case err != nil:
+			q.finish(job, JOB_FAILED, nil, err.Error())
+		case result.Reason == EXIT_REASON_USER_STOP:
+			q.finish(job, JOB_CANCELLED, result, "")
+		default:
+			q.finish(job, JOB_DONE, result, "")
+		}
+		status := q.status(job)
+		q.mu.Unlock()
+
+		q.dm.webhooks.Notify(job.Request.Callback, EVENT_JOB_COMPLETED, job.ID, status)
+	}
+}
+
+func (q *JobQueue) run(job *Job) (*ExecuteResult, error) {
+	containerID, err := q.dm.FindContainer(job.Request.Language)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+	defer func() {
+		if err := q.dm.DecreaseUser(containerID); err != nil {
+			log.Printf("Failed to remove container %s: %v", containerID, err)
+		}
+	}()
+
+	return q.dm.executeIn(containerID, job.Request, &batchControl{
+		stop: job.stop,
+		out:  job.out,
+		onState: func(state string) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			job.state = state
+		},
+		onQueued: func(position int) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			job.compileAt = position
+		},
+	})
+}
+
+// finish must be called with q.mu held.
+func (q *JobQueue) finish(job *Job, state string, result *ExecuteResult, err string) {
+	job.state = state
+	job.result = result
+	job.err = err
+	job.finishedAt = time.Now()
+
+	time.AfterFunc(JOB_RETENTION, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.jobs, job.ID)
+	})
+}
+
+// status must be called with q.mu held.
+func (q *JobQueue) status(job *Job) JobStatus {
+	status := JobStatus{
+		ID:        job.ID,
+		State:     job.state,
+		Result:    job.result,
+		Error:     job.err,
+		CreatedAt: job.createdAt,
+	}
+
+	if job.state == JOB_QUEUED {
+		for i, pending := range q.pending {
+			if pending == job {
+				status.QueuePosition = i + 1
+				break
+			}
+		}
+	}
+	if job.state == JOB_COMPILING {
+		status.QueuePosition = job.compileAt
+	}
+	if job.state == JOB_RUNNING {
+		status.Stdout, status.Stderr, status.Encoding = job.out.contents()
+	}
+	if !job.startedAt.IsZero() {
+		status.StartedAt = &job.startedAt
+	}
+	if !job.finishedAt.IsZero() {
+		status.FinishedAt = &job.finishedAt
+	}
+
+	return status
+}
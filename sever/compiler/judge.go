@@ -0,0 +1,356 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JUDGE_MAX_CASES         = 100
+	JUDGE_DEFAULT_TOLERANCE = 1e-6
+	JUDGE_TIME_BUDGET       = 5 * time.Minute
+)
+
+const (
+	VERDICT_ACCEPTED      = "Accepted"
+	VERDICT_WRONG_ANSWER  = "Wrong Answer"
+	VERDICT_TIME_LIMIT    = "Time Limit Exceeded"
+	VERDICT_MEMORY_LIMIT  = "Memory Limit Exceeded"
+	VERDICT_OUTPUT_LIMIT  = "Output Limit Exceeded"
+	VERDICT_RUNTIME       = "Runtime Error"
+	VERDICT_COMPILE       = "Compile Error"
+	VERDICT_PARTIAL       = "Partially Accepted"
+	VERDICT_CHECKER_ERROR = "Checker Error"
+)
+
+const (
+	COMPARE_EXACT      = "exact"
+	COMPARE_WHITESPACE = "whitespace"
+	COMPARE_FLOAT      = "float"
+)
+
+const EVENT_JUDGE_COMPLETED = "judge.completed"
+
+type TestCase struct {
+	Stdin    string `json:"stdin"`
+	Expected string `json:"expected"`
+	// Limits replaces the limits of the request for this case only
+	Limits *RunLimits `json:"limits,omitempty"`
+}
+
+// CompareOptions decides when the output of a case is accepted. Whitespace
+// comparison, the default, ignores how tokens are separated; float also
+// accepts numbers within Tolerance, absolute or relative.
+type CompareOptions struct {
+	Mode      string  `json:"mode"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+type JudgeRequest struct {
+	Language string `json:"language"`
+	Source
+	Flags   RunFlags       `json:"flags"`
+	Cases   []TestCase     `json:"cases"`
+	Limits  RunLimits      `json:"limits"`
+	Compare CompareOptions `json:"compare"`
+	// Checker replaces Compare when set
+	Checker *Checker `json:"checker,omitempty"`
+	// Interactor makes the problem interactive, Cases then only give its
+	// input and expected files
+	Interactor    *Interactor `json:"interactor,omitempty"`
+	StopOnFailure bool        `json:"stop_on_failure"`
+	Callback      *Callback   `json:"callback,omitempty"`
+}
+
+type CaseResult struct {
+	Index   int     `json:"index"`
+	Verdict string  `json:"verdict"`
+	Score   float64 `json:"score"`
+	Message string  `json:"message,omitempty"`
+	// Only for interactive problems
+	Transcript          []TranscriptEntry `json:"transcript,omitempty"`
+	TranscriptTruncated bool              `json:"transcript_truncated,omitempty"`
+	Interactor          *RunSummary       `json:"interactor,omitempty"`
+	ExecuteResult
+}
+
+// JudgeResult holds the first failing verdict, or Accepted when every case
+// passed. With StopOnFailure the cases after the first failure are not run.
+type JudgeResult struct {
+	RunID         string       `json:"run_id"`
+	Verdict       string       `json:"verdict"`
+	Passed        int          `json:"passed"`
+	Total         int          `json:"total"`
+	Score         float64      `json:"score"`
+	CompileOutput string       `json:"compile_output,omitempty"`
+	Diagnostics   []Diagnostic `json:"diagnostics,omitempty"`
+	// CheckerOutput is the compile output of the checker or interactor
+	CheckerOutput string       `json:"checker_output,omitempty"`
+	Cases         []CaseResult `json:"cases"`
+	// The cases left were not run, JUDGE_TIME_BUDGET ran out first
+	BudgetExceeded bool `json:"budget_exceeded,omitempty"`
+}
+
+func (req JudgeRequest) Validate() error {
+	if _, ok := LangImages[req.Language]; !ok {
+		return fmt.Errorf("unsupported language: %s", req.Language)
+	}
+	if err := req.Source.Validate(req.Language); err != nil {
+		return err
+	}
+	if len(req.Cases) == 0 {
+		return errors.New("at least one test case is required")
+	}
+	if len(req.Cases) > JUDGE_MAX_CASES {
+		return fmt.Errorf("at most %d test cases are allowed", JUDGE_MAX_CASES)
+	}
+	if err := req.Flags.Validate(req.Language); err != nil {
+		return err
+	}
+	if err := req.Compare.Validate(); err != nil {
+		return err
+	}
+	if err := req.Checker.Validate(); err != nil {
+		return err
+	}
+	if err := req.Interactor.Validate(); err != nil {
+		return err
+	}
+	if req.Checker != nil && req.Interactor != nil {
+		return errors.New("checker and interactor cannot be combined")
+	}
+	return req.Callback.Validate()
+}
+
+func (c CompareOptions) Validate() error {
+	switch c.Mode {
+	case "", COMPARE_EXACT, COMPARE_WHITESPACE, COMPARE_FLOAT:
+	default:
+		return fmt.Errorf("unknown compare mode: %s", c.Mode)
+	}
+	if c.Tolerance < 0 {
+		return errors.New("tolerance must not be negative")
+	}
+	return nil
+}
+
+// Judge compiles the code once and runs it against every test case on a
+// pooled container.
+func (dm *DockerManager) Judge(req JudgeRequest) (*JudgeResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	containerID, err := dm.FindContainer(req.Language)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+	defer func() {
+		if err := dm.DecreaseUser(containerID); err != nil {
+			log.Printf("Failed to remove container %s: %v", containerID, err)
+		}
+	}()
+
+	result, err := dm.judgeIn(containerID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.webhooks.Notify(req.Callback, EVENT_JUDGE_COMPLETED, result.RunID, result)
+	return result, nil
+}
+
+func (dm *DockerManager) judgeIn(containerID string, req JudgeRequest) (*JudgeResult, error) {
+	opt := LangImages[req.Language]
+	result := &JudgeResult{
+		RunID:   newID(),
+		Verdict: VERDICT_ACCEPTED,
+		Total:   len(req.Cases),
+		Cases:   []CaseResult{},
+	}
+
+	cmd, err := dm.buildCommand(req.Language, compileCaller{id: result.RunID}, req.Source, req.Flags)
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) {
+		result.Verdict = VERDICT_COMPILE
+		result.CompileOutput = compileErr.Output
+		result.Diagnostics = compileErr.Diagnostics
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ch, it *judgeProgram
+	if req.Checker != nil {
+		ch, err = dm.startChecker(req.Checker)
+	} else if req.Interactor != nil {
+		it, err = dm.startJudgeProgram(req.Interactor.Language, req.Interactor.Code, req.Interactor.Limits)
+	}
+	if errors.As(err, &compileErr) {
+		result.Verdict = VERDICT_CHECKER_ERROR
+		result.CheckerOutput = compileErr.Output
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Every run is cut short at the deadline, so the request as a whole is
+	// bounded too
+	deadline := time.Now().Add(JUDGE_TIME_BUDGET)
+	for _, p := range []*judgeProgram{ch, it} {
+		if p != nil {
+			p.deadline = deadline
+			defer dm.closeJudgeProgram(p)
+		}
+	}
+
+	for i, tc := range req.Cases {
+		if !time.Now().Before(deadline) {
+			result.BudgetExceeded = true
+			if result.Verdict == VERDICT_ACCEPTED {
+				result.Verdict = VERDICT_TIME_LIMIT
+			}
+			break
+		}
+
+		spec := execSpec{
+			runID:  newID(),
+			cmd:    cmd,
+			limits: req.Limits,
+		}
+		if tc.Limits != nil {
+			spec.limits = *tc.Limits
+		}
+		spec.applyLimits(opt)
+		spec.capWallTime(deadline)
+
+		var cr CaseResult
+		if it != nil {
+			cr, err = dm.interact(containerID, opt, spec, it, tc)
+		} else {
+			cr, err = dm.judgeCase(containerID, opt, spec, tc, req.Compare, ch)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cr.Index = i
+		result.Cases = append(result.Cases, cr)
+		result.Score += cr.Score
+
+		if cr.Verdict == VERDICT_ACCEPTED {
+			result.Passed++
+			continue
+		}
+		if result.Verdict == VERDICT_ACCEPTED {
+			result.Verdict = cr.Verdict
+		}
+		if req.StopOnFailure {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// judgeCase runs one case with the whole input upfront.
+func (dm *DockerManager) judgeCase(containerID string, opt LangOptions, spec execSpec, tc TestCase, cmp CompareOptions, ch *judgeProgram) (CaseResult, error) {
+	run, err := dm.runBatch(containerID, opt, spec, tc.Stdin, nil)
+	if err != nil {
+		return CaseResult{}, err
+	}
+
+	verdict, err := dm.caseVerdict(run, tc, cmp, ch)
+	if err != nil {
+		return CaseResult{}, err
+	}
+	return CaseResult{
+		Verdict:       verdict.verdict,
+		Score:         verdict.score,
+		Message:       verdict.message,
+		ExecuteResult: *run,
+	}, nil
+}
+
+// caseVerdict judges a finished run, with the checker when there is one.
+func (dm *DockerManager) caseVerdict(run *ExecuteResult, tc TestCase, cmp CompareOptions, ch *judgeProgram) (checkResult, error) {
+	if verdict := runVerdict(run.RunSummary); verdict != "" {
+		return checkResult{verdict: verdict}, nil
+	}
+
+	stdout, _, err := run.outputBytes()
+	if err != nil {
+		return checkResult{verdict: VERDICT_WRONG_ANSWER}, nil
+	}
+	if ch != nil {
+		return dm.check(ch, tc, stdout)
+	}
+
+	if !cmp.Equal(string(stdout), tc.Expected) {
+		return checkResult{verdict: VERDICT_WRONG_ANSWER}, nil
+	}
+	return checkResult{verdict: VERDICT_ACCEPTED, score: 1}, nil
+}
+
+// runVerdict returns the verdict of a run that did not exit cleanly, or ""
+// when its output still has to be judged.
+func runVerdict(summary RunSummary) string {
+	switch summary.Reason {
+	case EXIT_REASON_TIMEOUT, EXIT_REASON_CPU_LIMIT:
+		return VERDICT_TIME_LIMIT
+	case EXIT_REASON_OOM, EXIT_REASON_MEMORY_LIMIT:
+		return VERDICT_MEMORY_LIMIT
+	case EXIT_REASON_OUTPUT_LIMIT:
+		return VERDICT_OUTPUT_LIMIT
+	}
+	if summary.Reason != EXIT_REASON_EXITED || summary.ExitCode != 0 {
+		return VERDICT_RUNTIME
+	}
+	return ""
+}
+
+// Equal reports whether the output matches the expected output.
+func (c CompareOptions) Equal(output, expected string) bool {
+	switch c.Mode {
+	case COMPARE_EXACT:
+		return output == expected
+	case COMPARE_FLOAT:
+		got, want := strings.Fields(output), strings.Fields(expected)
+		if len(got) != len(want) {
+			return false
+		}
+		tolerance := c.Tolerance
+		if tolerance == 0 {
+			tolerance = JUDGE_DEFAULT_TOLERANCE
+		}
+		for i := range got {
+			if !floatTokenEqual(got[i], want[i], tolerance) {
+				return false
+			}
+		}
+		return true
+	default:
+		return slices.Equal(strings.Fields(output), strings.Fields(expected))
+	}
+}
+
+// floatTokenEqual compares two tokens as numbers when both parse, otherwise
+// as plain strings.
+func floatTokenEqual(got, want string, tolerance float64) bool {
+	if got == want {
+		return true
+	}
+	a, errA := strconv.ParseFloat(got, 64)
+	b, errB := strconv.ParseFloat(want, 64)
+	if errA != nil || errB != nil || math.IsNaN(a) || math.IsNaN(b) {
+		return false
+	}
+	diff := math.Abs(a - b)
+	return diff <= tolerance || diff <= tolerance*math.Abs(b)
+}
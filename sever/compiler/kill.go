@@ -0,0 +1,107 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	KILL_GRACE_PERIOD = 2 * time.Second
+	KILL_ATTEMPTS     = 5
+)
+
+// killRun terminates the whole process tree of a run with SIGTERM and, after
+// KILL_GRACE_PERIOD, SIGKILL. Containers are shared between users, so only
+// the run's own processes may be signalled. It reports the last signal sent
+// and whether the tree is gone.
+func (dm *DockerManager) killRun(containerID string, r *liveRun) (string, bool) {
+	dm.trackPid(context.Background(), r)
+
+	r.mu.Lock()
+	pid := r.pid
+	r.mu.Unlock()
+	if pid == 0 {
+		return "", false
+	}
+
+	if len(processTree(pid)) == 0 {
+		return "", true
+	}
+
+	dm.signalTree(containerID, pid, syscall.SIGTERM)
+	if waitTreeExit(pid, KILL_GRACE_PERIOD) {
+		return "SIGTERM", true
+	}
+
+	// Fork bombs keep spawning while we signal, so go over the tree a few times
+	for range KILL_ATTEMPTS {
+		dm.signalTree(containerID, pid, syscall.SIGKILL)
+		if waitTreeExit(pid, 200*time.Millisecond) {
+			return "SIGKILL", true
+		}
+	}
+
+	log.Printf("Process tree of run %s in container %s survived SIGKILL", r.id, containerID)
+	return "SIGKILL", false
+}
+
+func waitTreeExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if len(processTree(pid)) == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// signalTree signals from the host and falls back to a kill exec'd inside the
+// container when the server lacks permission to signal the sandbox user.
+func (dm *DockerManager) signalTree(containerID string, pid int, sig syscall.Signal) {
+	var denied []int
+	for _, p := range processTree(pid) {
+		if err := syscall.Kill(p.pid, sig); errors.Is(err, syscall.EPERM) {
+			denied = append(denied, p.pid)
+		}
+	}
+	if len(denied) == 0 {
+		return
+	}
+
+	var pids []string
+	for _, hostPid := range denied {
+		if id, err := nsPid(hostPid); err == nil {
+			pids = append(pids, strconv.Itoa(id))
+		}
+	}
+	if len(pids) == 0 {
+		return
+	}
+
+	if err := dm.execInContainer(containerID, []string{"sh", "-c", fmt.Sprintf("kill -%d %s", int(sig), strings.Join(pids, " "))}); err != nil {
+		log.Printf("Failed to signal processes in container %s: %v", containerID, err)
+	}
+}
+
+func (dm *DockerManager) execInContainer(containerID string, cmd []string) error {
+	ctx := context.Background()
+	execResp, err := dm.cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:  cmd,
+		User: "nobody",
+	})
+	if err != nil {
+		return err
+	}
+	return dm.cli.ContainerExecStart(ctx, execResp.ID, container.ExecStartOptions{})
+}
@@ -11,12 +11,26 @@ import (
 	"github.com/docker/docker/api/types/mount"
 )
 
+// C_STDIO_PREAMBLE turns off stdio buffering so output shows up while the
+// program runs.
+const C_STDIO_PREAMBLE = "#include <stdio.h>\n" +
+	"#ifdef __unix__\n" +
+	"#include <unistd.h>\n" +
+	"#endif\n" +
+	"void __attribute__((constructor)) initIO(void) {\n" +
+	"    setvbuf(stdout, NULL, _IONBF, 0);\n" +
+	"    setvbuf(stderr, NULL, _IONBF, 0);\n" +
+	"}\n"
+
 var LangImages = map[string]LangOptions{
 	"js": {
-		Image:      "node:22.14-alpine",
-		IsCompiled: false,
-		ExecCmd:    func(s string) []string { return []string{"node", "-e", s} },
-		CompileCmd: nil,
+		Image:        "node:22.14-alpine",
+		SourceName:   "main.js",
+		RuntimeFlags: sameFlags("--no-warnings", "--trace-uncaught", "--trace-warnings"),
+		Packages:     NPM_PACKAGES,
+		IsCompiled:   false,
+		ExecCmd:      func(s string) []string { return []string{"node", "-e", s} },
+		CompileCmd:   nil,
 		Mounts: []mount.Mount{
 			{
 				Type:     mount.TypeVolume,
@@ -24,14 +38,22 @@ var LangImages = map[string]LangOptions{
 				Target:   "/usr/local/lib/node_modules",
 				ReadOnly: true,
 			},
+			{
+				Type:     mount.TypeBind,
+				Source:   COMPILED_FILES,
+				Target:   CONTAINER_COMPILED_FILES,
+				ReadOnly: true,
+			},
 		},
-		RunOnHost:      nil,
 		MinCpu:         1,
 		MinMem:         128 * 1024 * 1024,
 		IncrementalMem: 100 * 1024 * 1024,
 		IncrementalCpu: 1,
 		MaxMem:         1024 * 1024 * 1024,
 		MaxCpu:         2,
+		WarmContainers: 1,
+		WallTimeLimit:  5 * time.Minute,
+		CPUTimeLimit:   60 * time.Second,
 		Env: []string{
 			"HOME=/tmp",
 			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
@@ -41,9 +63,24 @@ var LangImages = map[string]LangOptions{
 	},
 	"ts": {
 		Image:      "node:22.14-alpine",
-		IsCompiled: true,
-		ExecCmd:    func(s string) []string { return []string{"node", s} },
-		CompileCmd: nil,
+		SourceName: "main.ts",
+		CompileFlags: map[string][]string{
+			"--strict":             {"--strict"},
+			"--noImplicitAny":      {"--noImplicitAny"},
+			"--strictNullChecks":   {"--strictNullChecks"},
+			"--noUnusedLocals":     {"--noUnusedLocals"},
+			"--noUnusedParameters": {"--noUnusedParameters"},
+			"--target=es2020":      {"--target", "es2020"},
+			"--target=es2022":      {"--target", "es2022"},
+			"--target=esnext":      {"--target", "esnext"},
+		},
+		RuntimeFlags: sameFlags("--no-warnings", "--trace-uncaught", "--trace-warnings"),
+		IsCompiled:   true,
+		ExecCmd:      func(s string) []string { return []string{"node", "--enable-source-maps", s} },
+		CompileImage: TSC_IMAGE,
+		MaxCompiles:  2,
+
+		CompileCmd: func(file string) []string { return []string{"tsc", file, "--sourceMap", "-outDir", filepath.Dir(file)} },
 		Mounts: []mount.Mount{
 			{
 				Type:     mount.TypeVolume,
@@ -58,7 +95,6 @@ var LangImages = map[string]LangOptions{
 				ReadOnly: true,
 			},
 		},
-		RunOnHost:      func(file string) []string { return []string{"tsc", file, "-outDir", COMPILED_FILES} },
 		FileName:       func(cont string) string { return fmt.Sprintf("%s-%d-code.ts", cont, time.Now().UnixNano()) },
 		MinCpu:         1,
 		MinMem:         128 * 1024 * 1024,
@@ -66,6 +102,9 @@ var LangImages = map[string]LangOptions{
 		IncrementalCpu: 1,
 		MaxMem:         1024 * 1024 * 1024,
 		MaxCpu:         2,
+		WarmContainers: 1,
+		WallTimeLimit:  5 * time.Minute,
+		CPUTimeLimit:   60 * time.Second,
 		Env: []string{
 			"HOME=/tmp",
 			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
@@ -75,6 +114,15 @@ var LangImages = map[string]LangOptions{
 	},
 	"py": {
 		Image:      "python:3.12-alpine",
+		SourceName: "main.py",
+		RuntimeFlags: map[string][]string{
+			"-X dev":    {"-X", "dev"},
+			"-O":        {"-O"},
+			"-OO":       {"-OO"},
+			"-W error":  {"-W", "error"},
+			"-W ignore": {"-W", "ignore"},
+		},
+		Packages:   PIP_PACKAGES,
 		IsCompiled: false,
 		ExecCmd: func(s string) []string {
 			fileName := fmt.Sprintf("%s-%d-code.py", time.Now().Format("2006-01-02_15-04-05"), time.Now().UnixNano())
@@ -100,13 +148,15 @@ var LangImages = map[string]LangOptions{
 				ReadOnly: true,
 			},
 		},
-		RunOnHost:      nil,
 		MinCpu:         1,
 		MinMem:         128 * 1024 * 1024,
 		IncrementalMem: 100 * 1024 * 1024,
 		IncrementalCpu: 1,
 		MaxMem:         1024 * 1024 * 1024,
 		MaxCpu:         2,
+		WarmContainers: 2,
+		WallTimeLimit:  5 * time.Minute,
+		CPUTimeLimit:   60 * time.Second,
 		Env: []string{
 			"HOME=/tmp",
 			"PYTHONUNBUFFERED=1",
@@ -118,6 +168,15 @@ var LangImages = map[string]LangOptions{
 	},
 	"py-ml": {
 		Image:      "python:3.12-alpine",
+		SourceName: "main.py",
+		RuntimeFlags: map[string][]string{
+			"-X dev":    {"-X", "dev"},
+			"-O":        {"-O"},
+			"-OO":       {"-OO"},
+			"-W error":  {"-W", "error"},
+			"-W ignore": {"-W", "ignore"},
+		},
+		Packages:   PIP_PACKAGES,
 		IsCompiled: false,
 		ExecCmd: func(s string) []string {
 			return []string{"python3", "-c", s}
@@ -130,14 +189,21 @@ var LangImages = map[string]LangOptions{
 				Target:   "/opt/py-packages", // pip --target
 				ReadOnly: true,
 			},
+			{
+				Type:     mount.TypeBind,
+				Source:   COMPILED_FILES,
+				Target:   CONTAINER_COMPILED_FILES,
+				ReadOnly: true,
+			},
 		},
-		RunOnHost:      nil,
 		MinCpu:         2,
 		MinMem:         256 * 1024 * 1024,
 		IncrementalMem: 100 * 1024 * 1024,
 		IncrementalCpu: 1,
 		MaxMem:         1024 * 1024 * 1024,
 		MaxCpu:         4,
+		WallTimeLimit:  10 * time.Minute,
+		CPUTimeLimit:   300 * time.Second,
 		Env: []string{
 			"HOME=/tmp",
 			"PYTHONUNBUFFERED=1",
@@ -149,6 +215,14 @@ var LangImages = map[string]LangOptions{
 	},
 	"c": {
 		Image:      "debian:12.10-slim",
+		SourceName: "main.c",
+		Preamble:   C_STDIO_PREAMBLE,
+		CompileFlags: sameFlags(
+			"-std=c99", "-std=c11", "-std=c17", "-std=gnu11", "-std=gnu17",
+			"-O0", "-O1", "-O2", "-O3", "-g",
+			"-Wall", "-Wextra", "-Werror", "-pedantic",
+			"-lm",
+		),
 		IsCompiled: true,
 		ExecCmd:    func(s string) []string { return []string{s} },
 		Mounts: []mount.Mount{
@@ -159,8 +233,11 @@ var LangImages = map[string]LangOptions{
 				ReadOnly: true,
 			},
 		},
-		RunOnHost: func(file string) []string {
-			return []string{"gcc", file, "-o", COMPILED_FILES + "/" + strings.TrimSuffix(filepath.Base(file), ".c") + ".out"}
+		CompileImage: "gcc:14", // the same glibc as debian 12
+		MaxCompiles:  4,
+
+		CompileCmd: func(file string) []string {
+			return []string{"gcc", file, "-o", strings.TrimSuffix(file, ".c") + ".out"}
 		},
 		FileName: func(containerID string) string {
 			return fmt.Sprintf("%s-%d-code.c", containerID, time.Now().UnixNano())
@@ -171,11 +248,20 @@ var LangImages = map[string]LangOptions{
 		IncrementalCpu:   1,
 		MaxMem:           1024 * 1024 * 1024,
 		MaxCpu:           2,
+		WarmContainers:   1,
+		WallTimeLimit:    5 * time.Minute,
+		CPUTimeLimit:     30 * time.Second,
 		CpuIdleThreshold: 3,
 		MemIdleThreshold: 5,
 	},
 	"cpp": {
 		Image:      "gcc:14",
+		SourceName: "main.cpp",
+		CompileFlags: sameFlags(
+			"-std=c++11", "-std=c++14", "-std=c++17", "-std=c++20", "-std=c++23",
+			"-O0", "-O1", "-O2", "-O3", "-g",
+			"-Wall", "-Wextra", "-Werror", "-pedantic",
+		),
 		IsCompiled: true,
 		ExecCmd:    func(s string) []string { return []string{s} },
 		Mounts: []mount.Mount{
@@ -186,8 +272,10 @@ var LangImages = map[string]LangOptions{
 				ReadOnly: true,
 			},
 		},
-		RunOnHost: func(file string) []string {
-			return []string{"g++", file, "-o", COMPILED_FILES + "/" + strings.TrimSuffix(filepath.Base(file), ".cpp") + ".out"}
+		CompileImage: "gcc:14",
+		MaxCompiles:  4,
+		CompileCmd: func(file string) []string {
+			return []string{"g++", file, "-o", strings.TrimSuffix(file, ".cpp") + ".out"}
 		},
 		FileName: func(containerID string) string {
 			return fmt.Sprintf("%s-%d-code.cpp", containerID, time.Now().UnixNano())
@@ -198,23 +286,30 @@ var LangImages = map[string]LangOptions{
 		IncrementalCpu:   1,
 		MaxMem:           1024 * 1024 * 1024,
 		MaxCpu:           2,
+		WarmContainers:   1,
+		WallTimeLimit:    5 * time.Minute,
+		CPUTimeLimit:     30 * time.Second,
 		CpuIdleThreshold: 3,
 		MemIdleThreshold: 5,
 	},
 	"java": {
 		Image:      "openjdk:21-slim",
-		IsCompiled: true,
-		ExecCmd: func(s string) []string { // s = /tmp/tmp_compiled/<user>
-			files, err := os.ReadDir(s)
-			if err != nil {
-				return []string{"java", "-cp", s, "Main"}
-			}
-			for _, file := range files {
-				if strings.HasSuffix(file.Name(), ".class") {
-					return []string{"java", "-cp", s, strings.TrimSuffix(file.Name(), ".class")}
-				}
-			}
-			return []string{"java", "-cp", s, "Main"}
+		SourceName: "Main.java",
+		CompileFlags: map[string][]string{
+			// Preview features are tied to the exact release
+			"--enable-preview": {"--enable-preview", "--release", "21"},
+			"-Xlint":           {"-Xlint"},
+			"-Werror":          {"-Werror"},
+		},
+		RuntimeFlags: sameFlags("--enable-preview", "-ea"),
+		IsCompiled:   true,
+		CompileImage: "openjdk:21-slim",
+		MaxCompiles:  2,
+
+		// Java always builds like a project so javac sees the file named
+		// after its public class, see buildProject
+		ExecCmd: func(s string) []string { // s = <classes dir>/<main class>
+			return []string{"java", "-cp", filepath.Dir(s), filepath.Base(s)}
 		},
 		Mounts: []mount.Mount{
 			{
@@ -224,22 +319,15 @@ var LangImages = map[string]LangOptions{
 				ReadOnly: true,
 			},
 		},
-		RunOnHost: func(file string) []string {
-			id := time.Now().UnixNano()
-			userId := fmt.Sprintf("%d-%d", id, len(file))
-			compiledDir := filepath.Join(COMPILED_FILES, userId)
-			_ = os.MkdirAll(compiledDir, 0755)
-			return []string{"javac", "-d", compiledDir, file}
-		},
-		FileName: func(containerID string) string {
-			return fmt.Sprintf("%s-%d-code.java", containerID, time.Now().UnixNano())
-		},
 		MinCpu:         1,
 		MinMem:         256 * 1024 * 1024,
 		IncrementalMem: 128 * 1024 * 1024,
 		IncrementalCpu: 1,
 		MaxMem:         1024 * 1024 * 1024,
 		MaxCpu:         2,
+		WarmContainers: 1,
+		WallTimeLimit:  5 * time.Minute,
+		CPUTimeLimit:   60 * time.Second,
 		Env: []string{
 			"HOME=/tmp",
 			"PATH=/usr/local/openjdk-21/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
@@ -249,6 +337,11 @@ var LangImages = map[string]LangOptions{
 	},
 	"php": {
 		Image:      "php:8.3-cli",
+		SourceName: "main.php",
+		RuntimeFlags: map[string][]string{
+			"-d display_errors=stderr": {"-d", "display_errors=stderr"},
+			"-d error_reporting=E_ALL": {"-d", "error_reporting=E_ALL"},
+		},
 		IsCompiled: false,
 		ExecCmd: func(s string) []string {
 			fileName := fmt.Sprintf("%s-%d-code.php", time.Now().Format("2006-01-02_15-04-05"), time.Now().UnixNano())
@@ -267,7 +360,6 @@ var LangImages = map[string]LangOptions{
 				ReadOnly: true,
 			},
 		},
-		RunOnHost:      nil,
 		FileName:       nil,
 		MinCpu:         1,
 		MinMem:         64 * 1024 * 1024,
@@ -275,6 +367,8 @@ var LangImages = map[string]LangOptions{
 		IncrementalCpu: 1,
 		MaxMem:         256 * 1024 * 1024,
 		MaxCpu:         1,
+		WallTimeLimit:  2 * time.Minute,
+		CPUTimeLimit:   30 * time.Second,
 		Env: []string{
 			"HOME=/tmp",
 			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
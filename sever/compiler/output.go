@@ -0,0 +1,206 @@
+package compiler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	OUTPUT_MAX_BYTES   = 1024 * 1024
+	OUTPUT_MAX_LINES   = 10_000
+	OUTPUT_FLOW_WINDOW = 256 * 1024
+	ARTIFACTS_DIR      = "/tmp/run_artifacts"
+	ARTIFACT_MAX_BYTES = 64 * 1024 * 1024
+	ARTIFACT_TTL       = time.Hour
+)
+
+// outputLimiter is shared by the stdout and stderr writers of a run. Once
+// the byte or line cap is hit nothing more is streamed; with spilling the
+// full output keeps going to an artifact file the client can download.
+type outputLimiter struct {
+	mu         sync.Mutex
+	maxBytes   int64
+	maxLines   int64
+	bytes      int64
+	lines      int64
+	truncated  bool
+	spill      *os.File
+	artifactID string
+	spilled    int64
+	onExceeded func()
+	exceeded   bool
+}
+
+func newOutputLimiter(limits RunLimits, spill bool, onExceeded func()) (*outputLimiter, error) {
+	l := &outputLimiter{
+		maxBytes:   OUTPUT_MAX_BYTES,
+		maxLines:   OUTPUT_MAX_LINES,
+		onExceeded: onExceeded,
+	}
+	if limits.OutputBytes > 0 && limits.OutputBytes < l.maxBytes {
+		l.maxBytes = limits.OutputBytes
+	}
+	if limits.OutputLines > 0 && limits.OutputLines < l.maxLines {
+		l.maxLines = limits.OutputLines
+	}
+
+	if spill {
+		id := newToken()
+		f, err := os.OpenFile(filepath.Join(ARTIFACTS_DIR, id+".log"), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output artifact: %w", err)
+		}
+		l.spill = f
+		l.artifactID = id
+	}
+
+	return l, nil
+}
+
+// admit returns the part of p that may still be streamed to the client and,
+// the first time output goes past the cap, the truncation notice to send
+// after it. Output that ends exactly at the cap is not truncated.
+func (l *outputLimiter) admit(p []byte) ([]byte, *TruncatedPayload) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.spill != nil && !l.exceeded {
+		n := min(int64(len(p)), ARTIFACT_MAX_BYTES-l.spilled)
+		if _, err := l.spill.Write(p[:n]); err != nil {
+			log.Printf("failed to write output artifact: %v", err)
+		}
+		l.spilled += n
+		if n < int64(len(p)) {
+			l.exceed()
+		}
+	}
+
+	if l.truncated {
+		return nil, nil
+	}
+
+	allowed, cut := p, false
+	if remaining := l.maxBytes - l.bytes; int64(len(allowed)) > remaining {
+		allowed, cut = allowed[:remaining], true
+	}
+	// Anything after the last allowed line is over the cap
+	for i, lines := 0, l.lines; i < len(allowed); i++ {
+		if lines >= l.maxLines {
+			allowed, cut = allowed[:i], true
+			break
+		}
+		if allowed[i] == '\n' {
+			lines++
+		}
+	}
+
+	l.bytes += int64(len(allowed))
+	l.lines += int64(bytes.Count(allowed, []byte{'\n'}))
+
+	if !cut {
+		return allowed, nil
+	}
+
+	l.truncated = true
+	if l.spill == nil {
+		l.exceed()
+	}
+	return allowed, &TruncatedPayload{
+		MaxBytes:   l.maxBytes,
+		MaxLines:   l.maxLines,
+		ArtifactID: l.artifactID,
+	}
+}
+
+func (l *outputLimiter) exceed() {
+	if l.exceeded {
+		return
+	}
+	l.exceeded = true
+	if l.onExceeded != nil {
+		go l.onExceeded()
+	}
+}
+
+// close finishes the artifact and reports what ends up in the run summary.
+func (l *outputLimiter) close() (int64, bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.spill != nil {
+		l.spill.Close()
+		path := l.spill.Name()
+		time.AfterFunc(ARTIFACT_TTL, func() { os.Remove(path) })
+	}
+	return l.bytes, l.truncated, l.artifactID
+}
+
+// ArtifactPath returns the file holding the spilled output of a run. Ids are
+// tokens, 32 lowercase hex characters.
+func ArtifactPath(id string) (string, error) {
+	if len(id) != 32 {
+		return "", fmt.Errorf("invalid artifact id")
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", fmt.Errorf("invalid artifact id")
+		}
+	}
+	path := filepath.Join(ARTIFACTS_DIR, id+".log")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("artifact not found")
+	}
+	return path, nil
+}
+
+// ack records how far the client has rendered. The first ack switches the
+// session to flow control, after that output only flows while less than
+// OUTPUT_FLOW_WINDOW bytes are unacknowledged.
+func (s *Session) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flowControl = true
+	for _, msg := range s.buffer {
+		if msg.seq == seq {
+			s.ackedBytes = max(s.ackedBytes, msg.offset)
+			break
+		}
+	}
+	if seq >= s.seq {
+		s.ackedBytes = s.sentBytes
+	}
+	s.flowCond.Broadcast()
+}
+
+// waitForWindow blocks the output reader of a run, and so the program
+// itself, while the client is behind.
+func (s *Session) waitForWindow(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		s.flowCond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.flowControl && s.sentBytes-s.ackedBytes >= OUTPUT_FLOW_WINDOW {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-s.done:
+			return ErrSessionClosed
+		default:
+		}
+		s.flowCond.Wait()
+	}
+	return nil
+}
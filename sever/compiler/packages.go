@@ -0,0 +1,255 @@
+package compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+const (
+	// Filled by the admin: wheels under pip/, an npm cache under npm/
+	PACKAGE_MIRROR_DIR         = "/srv/ide-mirror"
+	PACKAGES_MAX_DEPS          = 20
+	PACKAGES_MAX_BYTES         = 256 * 1024 * 1024
+	PACKAGE_INSTALL_TIME_LIMIT = 2 * time.Minute
+)
+
+// PackageManager installs the dependencies a run declares into a directory of
+// their own, offline from the mirror on the server. Runs see it on top of the
+// packages of the language image.
+type PackageManager struct {
+	Mirror  string          // mounted read only while installing
+	Allowed map[string]bool // by normalized name
+	// Parse returns the normalized package name of a dependency, false when
+	// its syntax is not supported
+	Parse    func(dep string) (string, bool)
+	Manifest func(files map[string]string) ([]string, error) // what a project lists
+	Install  func(mirror, dir string, deps []string) []string
+	Env      func(dir string) []string
+}
+
+var (
+	// requests or requests==2.32.3
+	pipRequirement   = regexp.MustCompile(`^([A-Za-z0-9](?:[A-Za-z0-9._-]*[A-Za-z0-9])?)(?:==([A-Za-z0-9.+!_-]+))?$`)
+	pipNameSeparator = regexp.MustCompile(`[-_.]+`)
+	// lodash, lodash@^4.17.21 or @scope/name@1.0.0
+	npmDependency = regexp.MustCompile(`^((?:@[a-z0-9][a-z0-9._-]*/)?[a-z0-9][a-z0-9._-]*)(?:@([\w.^~<>=*+-]+))?$`)
+)
+
+var PIP_PACKAGES = &PackageManager{
+	Mirror: PACKAGE_MIRROR_DIR + "/pip",
+	Allowed: allowPackages(
+		"attrs", "beautifulsoup4", "matplotlib", "networkx", "numpy", "pandas",
+		"pillow", "python-dateutil", "pytz", "pyyaml", "requests", "rich",
+		"scikit-learn", "scipy", "sympy", "tabulate",
+	),
+	Parse: func(dep string) (string, bool) {
+		m := pipRequirement.FindStringSubmatch(dep)
+		if m == nil {
+			return "", false
+		}
+		// PEP 503 normalization
+		return strings.ToLower(pipNameSeparator.ReplaceAllString(m[1], "-")), true
+	},
+	Manifest: func(files map[string]string) ([]string, error) {
+		var deps []string
+		for _, line := range strings.Split(files["requirements.txt"], "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				deps = append(deps, line)
+			}
+		}
+		return deps, nil
+	},
+	Install: func(mirror, dir string, deps []string) []string {
+		return append([]string{
+			"pip", "install", "--no-index", "--find-links", mirror, "--only-binary=:all:",
+			"--no-cache-dir", "--disable-pip-version-check", "--target", dir,
+		}, deps...)
+	},
+	Env: func(dir string) []string {
+		return []string{"PYTHONPATH=" + dir + ":/opt/py-packages"}
+	},
+}
+
+var NPM_PACKAGES = &PackageManager{
+	Mirror: PACKAGE_MIRROR_DIR + "/npm",
+	Allowed: allowPackages(
+		"chalk", "date-fns", "dayjs", "immutable", "lodash", "mathjs", "moment",
+		"ramda", "underscore", "uuid", "zod",
+	),
+	Parse: func(dep string) (string, bool) {
+		m := npmDependency.FindStringSubmatch(dep)
+		if m == nil {
+			return "", false
+		}
+		return m[1], true
+	},
+	Manifest: func(files map[string]string) ([]string, error) {
+		content, ok := files["package.json"]
+		if !ok {
+			return nil, nil
+		}
+		var manifest struct {
+			Dependencies map[string]string `json:"dependencies"`
+		}
+		if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+			return nil, fmt.Errorf("invalid package.json: %w", err)
+		}
+		var deps []string
+		for name, version := range manifest.Dependencies {
+			deps = append(deps, name+"@"+version)
+		}
+		return deps, nil
+	},
+	Install: func(mirror, dir string, deps []string) []string {
+		return append([]string{
+			"npm", "install", "--offline", "--cache", mirror, "--prefix", dir,
+			"--no-audit", "--no-fund", "--no-package-lock", "--ignore-scripts", "--logs-max=0",
+		}, deps...)
+	},
+	Env: func(dir string) []string {
+		return []string{"NODE_PATH=" + dir + "/node_modules:/usr/local/lib/node_modules"}
+	},
+}
+
+func allowPackages(names ...string) map[string]bool {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return allowed
+}
+
+// dependencies returns what the source asks to install: the listed
+// dependencies and those in the manifest of a project.
+func (s Source) dependencies(lang string) ([]string, error) {
+	deps := slices.Clone(s.Dependencies)
+	pm := LangImages[lang].Packages
+	if pm == nil || !s.isProject() {
+		return deps, nil
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	listed, err := pm.Manifest(files)
+	if err != nil {
+		return nil, err
+	}
+	return append(deps, listed...), nil
+}
+
+func (s Source) validateDependencies(lang string) error {
+	deps, err := s.dependencies(lang)
+	if err != nil || len(deps) == 0 {
+		return err
+	}
+
+	pm := LangImages[lang].Packages
+	if pm == nil {
+		return fmt.Errorf("dependencies are not supported for %s", lang)
+	}
+	if len(deps) > PACKAGES_MAX_DEPS {
+		return fmt.Errorf("at most %d dependencies are allowed", PACKAGES_MAX_DEPS)
+	}
+	for _, dep := range deps {
+		name, ok := pm.Parse(dep)
+		if !ok {
+			return fmt.Errorf("unsupported dependency %q", dep)
+		}
+		if !pm.Allowed[name] {
+			return fmt.Errorf("package %s is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// installPackages installs deps into a directory of their own and returns the
+// environment that points runs at it. Installed sets are kept in the compile
+// cache, so the same dependencies are installed once.
+func (dm *DockerManager) installPackages(lang string, caller compileCaller, deps []string) ([]string, error) {
+	opt := LangImages[lang]
+	pm := opt.Packages
+
+	deps = slices.Clone(deps)
+	sort.Strings(deps)
+	deps = slices.Compact(deps)
+
+	key := dm.compileKey(lang, RunFlags{}, nil, append([]string{"packages", dm.imageIDs[opt.Image]}, deps...)...)
+	if env, ok := dm.compileCache.Get(key); ok {
+		return env, nil
+	}
+
+	return dm.compiles.Do(lang, key, caller, func() ([]string, error) {
+		dir, err := newBuildDir("pkgs")
+		if err != nil {
+			return nil, err
+		}
+
+		out, ok, err := dm.runInSandbox(sandboxSpec{
+			name:  "package installation",
+			image: opt.Image,
+			env:   opt.Env,
+			dir:   dir,
+			cmd:   pm.Install(pm.Mirror, dir, deps),
+			readOnly: []mount.Mount{
+				{
+					Type:   mount.TypeBind,
+					Source: pm.Mirror,
+					Target: pm.Mirror,
+				},
+			},
+			timeLimit: PACKAGE_INSTALL_TIME_LIMIT,
+		})
+		if err != nil || !ok {
+			os.RemoveAll(dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("failed to install %s packages: %v", lang, deps)
+			return nil, &CompileError{Output: "failed to install dependencies:\n" + out}
+		}
+
+		size, err := dirSize(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to size installed dependencies: %w", err)
+		}
+		if size > PACKAGES_MAX_BYTES {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("installed dependencies are larger than %d bytes", PACKAGES_MAX_BYTES)
+		}
+
+		env := pm.Env(dir)
+		dm.compileCache.Put(key, dir, env)
+		return env, nil
+	})
+}
+
+// createMirrorDirs makes sure the mirrors exist so they can be mounted, even
+// when nothing was put in them yet.
+func createMirrorDirs() error {
+	for _, opt := range LangImages {
+		if opt.Packages == nil {
+			continue
+		}
+		if err := os.MkdirAll(opt.Packages.Mirror, 0755); err != nil {
+			return fmt.Errorf("failed to create package mirror: %w", err)
+		}
+	}
+	return nil
+}
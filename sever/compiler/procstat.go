@@ -0,0 +1,209 @@
+package compiler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USER_HZ, the unit of the cpu counters in /proc/<pid>/stat
+const CLOCK_TICKS = 100
+
+type procInfo struct {
+	pid     int
+	ppid    int
+	session int
+	cpuTime time.Duration
+}
+
+type procUsage struct {
+	cpuTime time.Duration
+	memory  int64
+}
+
+// Exec'd processes are session leaders (runc calls setsid), so everything
+// they spawn shares their session id even after being reparented to the
+// container's init.
+func processTree(root int) []procInfo {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	procs := make(map[int]procInfo)
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		info, err := readProcStat(pid)
+		if err != nil {
+			continue
+		}
+		procs[pid] = info
+		children[info.ppid] = append(children[info.ppid], pid)
+	}
+
+	// The root may already be gone while orphans of its session live on
+	seen := map[int]bool{}
+	var queue []int
+	if _, ok := procs[root]; ok {
+		queue = append(queue, root)
+	}
+	for pid, info := range procs {
+		if info.session == root {
+			queue = append(queue, pid)
+		}
+	}
+
+	var tree []procInfo
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		tree = append(tree, procs[pid])
+		queue = append(queue, children[pid]...)
+	}
+	return tree
+}
+
+func readProcStat(pid int) (procInfo, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procInfo{}, err
+	}
+
+	// The command name may contain spaces, fields start after its closing paren
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return procInfo{}, fmt.Errorf("malformed stat for %d", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 15 {
+		return procInfo{}, fmt.Errorf("malformed stat for %d", pid)
+	}
+
+	info := procInfo{pid: pid}
+	info.ppid, _ = strconv.Atoi(fields[1])
+	info.session, _ = strconv.Atoi(fields[3])
+
+	var ticks int64
+	for _, f := range fields[11:15] { // utime, stime, cutime, cstime
+		n, _ := strconv.ParseInt(f, 10, 64)
+		ticks += n
+	}
+	info.cpuTime = time.Duration(ticks) * time.Second / CLOCK_TICKS
+
+	return info, nil
+}
+
+// readProcMemory returns the current and peak resident set size in bytes.
+func readProcMemory(pid int) (int64, int64) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var rss, hwm int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "VmRSS:":
+			rss = kb * 1024
+		case "VmHWM:":
+			hwm = kb * 1024
+		}
+	}
+	return rss, hwm
+}
+
+// nsPid returns the pid of a host process as seen inside its container.
+func nsPid(pid int) (int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "NSpid:" {
+			return strconv.Atoi(fields[len(fields)-1])
+		}
+	}
+	return 0, fmt.Errorf("no NSpid for %d", pid)
+}
+
+func treeUsage(root int) procUsage {
+	var usage procUsage
+	var peak int64
+	for _, p := range processTree(root) {
+		usage.cpuTime += p.cpuTime
+		rss, hwm := readProcMemory(p.pid)
+		usage.memory += rss
+		peak = max(peak, hwm)
+	}
+	usage.memory = max(usage.memory, peak)
+	return usage
+}
+
+// oomEventsFile locates the cgroup file holding the oom_kill counter of the
+// cgroup pid belongs to, for both cgroup v2 and v1 hosts.
+func oomEventsFile(pid int) string {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return filepath.Join("/sys/fs/cgroup", parts[2], "memory.events")
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				return filepath.Join("/sys/fs/cgroup/memory", parts[2], "memory.oom_control")
+			}
+		}
+	}
+	return ""
+}
+
+func readOOMKills(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,372 @@
+package compiler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PROJECT_MAX_FILES = 200
+	PROJECT_MAX_BYTES = 4 * 1024 * 1024
+	WORKSPACE_TTL     = time.Hour
+)
+
+// Source is the code of a run: either a single snippet or a project given as
+// a file tree and/or a tar, tar.gz or zip archive (base64 in JSON), run from
+// its entrypoint.
+type Source struct {
+	Code       string            `json:"code"`
+	Files      map[string]string `json:"files,omitempty"`
+	Archive    []byte            `json:"archive,omitempty"`
+	Entrypoint string            `json:"entrypoint,omitempty"`
+	// Java only, the class to run instead of the detected one
+	MainClass string `json:"main_class,omitempty"`
+	// Packages to install from the mirror of the server, like requests==2.32.3
+	// or lodash@4.17.21. Projects may list them in requirements.txt or
+	// package.json instead.
+	Dependencies []string `json:"dependencies,omitempty"`
+}
+
+// Projects compile every source file of the language, the other languages
+// start from the entrypoint.
+var projectSources = map[string][]string{
+	"c":    {".c"},
+	"cpp":  {".cpp", ".cc", ".cxx"},
+	"java": {".java"},
+	"ts":   {".ts"},
+}
+
+// Project files are written to COMPILED_FILES/ws-<token>/ and packages to
+// COMPILED_FILES/pkgs-<token>/, which the rewriter turns back into the paths
+// the user knows
+var workspacePath = regexp.MustCompile(`^` + regexp.QuoteMeta(COMPILED_FILES) + `/(?:ws|pkgs)-[0-9a-f]+/(?:out/|classes/|node_modules/)?`)
+
+func (s Source) isProject() bool {
+	return len(s.Files) > 0 || len(s.Archive) > 0
+}
+
+// asJavaProject turns a single java snippet into a project with the file
+// named and placed the way javac requires.
+func (s Source) asJavaProject() Source {
+	return Source{
+		Files:     map[string]string{parseJavaSource(s.Code).fileName(): s.Code},
+		MainClass: s.MainClass,
+	}
+}
+
+func (s Source) Validate(lang string) error {
+	if s.MainClass != "" {
+		if lang != "java" {
+			return errors.New("a main class can only be set for java")
+		}
+		if !javaMainClass.MatchString(s.MainClass) {
+			return fmt.Errorf("invalid main class %q", s.MainClass)
+		}
+	}
+	if err := s.validateDependencies(lang); err != nil {
+		return err
+	}
+
+	if !s.isProject() {
+		if s.Code == "" {
+			return errors.New("code is required")
+		}
+		return nil
+	}
+	if s.Code != "" {
+		return errors.New("code cannot be combined with files or an archive")
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	if s.Entrypoint == "" {
+		if _, compiled := projectSources[lang]; !compiled || lang == "ts" {
+			return fmt.Errorf("an entrypoint is required for %s projects", lang)
+		}
+		return nil
+	}
+	if _, ok := files[s.Entrypoint]; !ok {
+		return fmt.Errorf("entrypoint %s is not one of the files", s.Entrypoint)
+	}
+	return nil
+}
+
+// files returns the file tree with the archive unpacked into it.
+func (s Source) files() (map[string]string, error) {
+	files := make(map[string]string, len(s.Files))
+	total := 0
+	add := func(name string, content []byte) error {
+		clean, err := cleanProjectPath(name)
+		if err != nil {
+			return err
+		}
+		total += len(content)
+		if total > PROJECT_MAX_BYTES {
+			return fmt.Errorf("project is larger than %d bytes", PROJECT_MAX_BYTES)
+		}
+		files[clean] = string(content)
+		if len(files) > PROJECT_MAX_FILES {
+			return fmt.Errorf("project has more than %d files", PROJECT_MAX_FILES)
+		}
+		return nil
+	}
+
+	for name, content := range s.Files {
+		if err := add(name, []byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.Archive) > 0 {
+		if err := readArchive(s.Archive, add); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("project has no files")
+	}
+	return files, nil
+}
+
+func cleanProjectPath(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid file path %q", name)
+	}
+	return clean, nil
+}
+
+// readArchive detects the archive format and passes every regular file to add.
+func readArchive(data []byte, add func(string, []byte) error) error {
+	// Never read more than the project may hold, whatever the headers claim
+	read := func(r io.Reader) ([]byte, error) {
+		content, err := io.ReadAll(io.LimitReader(r, PROJECT_MAX_BYTES+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > PROJECT_MAX_BYTES {
+			return nil, fmt.Errorf("project is larger than %d bytes", PROJECT_MAX_BYTES)
+		}
+		return content, nil
+	}
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("invalid zip archive: %w", err)
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("invalid zip archive: %w", err)
+			}
+			content, err := read(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := add(f.Name, content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("invalid gzip archive: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := read(tr)
+		if err != nil {
+			return err
+		}
+		if err := add(hdr.Name, content); err != nil {
+			return err
+		}
+	}
+}
+
+// writeWorkspace writes the project into a fresh directory the run
+// containers see through the compiled files mount.
+func writeWorkspace(files map[string]string) (string, error) {
+	dir, err := newBuildDir("ws")
+	if err != nil {
+		return "", err
+	}
+
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to write workspace: %w", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to write workspace: %w", err)
+		}
+	}
+	return dir, nil
+}
+
+// buildProject writes the project to a workspace, compiles it in the sandbox
+// when the language needs it and returns the command to exec in the
+// container. Compiled projects come from the compile cache when they can,
+// other workspaces are removed once no run can still be using them.
+func (dm *DockerManager) buildProject(lang string, caller compileCaller, src Source, flags RunFlags) ([]string, error) {
+	opt := LangImages[lang]
+
+	files, err := src.files()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, compiled := projectSources[lang]; !compiled {
+		dir, err := writeWorkspace(files)
+		if err != nil {
+			return nil, err
+		}
+		removeAfter(dir, WORKSPACE_TTL)
+		run, err := dm.buildWorkspace(lang, src, flags, files, dir)
+		if err != nil {
+			return nil, err
+		}
+		return withRuntimeFlags(run, opt, flags.Runtime), nil
+	}
+
+	key := dm.compileKey(lang, flags, files, "project", src.Entrypoint, src.MainClass)
+	if run, ok := dm.compileCache.Get(key); ok {
+		return withRuntimeFlags(run, opt, flags.Runtime), nil
+	}
+
+	run, err := dm.compiles.Do(lang, key, caller, func() ([]string, error) {
+		dir, err := writeWorkspace(files)
+		if err != nil {
+			return nil, err
+		}
+		run, err := dm.buildWorkspace(lang, src, flags, files, dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		dm.compileCache.Put(key, dir, run)
+		return run, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withRuntimeFlags(run, opt, flags.Runtime), nil
+}
+
+// buildWorkspace compiles the project written to dir when the language needs
+// it and returns the command that runs it, before runtime flags.
+func (dm *DockerManager) buildWorkspace(lang string, src Source, flags RunFlags, files map[string]string, dir string) ([]string, error) {
+	opt := LangImages[lang]
+
+	var sources []string
+	for name := range files {
+		for _, ext := range projectSources[lang] {
+			if filepath.Ext(name) == ext {
+				sources = append(sources, filepath.Join(dir, filepath.FromSlash(name)))
+			}
+		}
+	}
+	sort.Strings(sources)
+	entry := filepath.Join(dir, filepath.FromSlash(src.Entrypoint))
+
+	var compile, run []string
+	switch lang {
+	case "c", "cpp":
+		if len(sources) == 0 {
+			return nil, fmt.Errorf("project has no %s files", strings.Join(projectSources[lang], " or "))
+		}
+		binary := filepath.Join(dir, "main.out")
+		compiler := "gcc"
+		if lang == "cpp" {
+			compiler = "g++"
+		}
+		if opt.Preamble != "" {
+			// As its own translation unit so no line of the project moves
+			preamble := filepath.Join(dir, ".preamble.c")
+			if err := os.WriteFile(preamble, []byte(opt.Preamble), 0644); err != nil {
+				return nil, fmt.Errorf("failed to write workspace: %w", err)
+			}
+			sources = append(sources, preamble)
+		}
+		compile = append(append([]string{compiler}, sources...), "-I", dir, "-o", binary)
+		run = opt.ExecCmd(binary)
+	case "java":
+		mainClass, err := javaProjectMainClass(files, src.Entrypoint, src.MainClass)
+		if err != nil {
+			return nil, &CompileError{Output: err.Error()}
+		}
+		// javac puts the classes under their package directories
+		classes := filepath.Join(dir, "classes")
+		compile = append([]string{"javac", "-d", classes}, sources...)
+		run = opt.ExecCmd(filepath.Join(classes, mainClass))
+	case "ts":
+		out := filepath.Join(dir, "out")
+		compile = append([]string{"tsc"}, sources...)
+		compile = append(compile, "--sourceMap", "--rootDir", dir, "-outDir", out)
+		run = opt.ExecCmd(filepath.Join(out, strings.TrimSuffix(filepath.FromSlash(src.Entrypoint), ".ts")+".js"))
+	case "py", "py-ml":
+		run = []string{"python3", entry}
+	case "js":
+		run = []string{"node", entry}
+	case "php":
+		run = []string{"php", entry}
+	default:
+		return nil, fmt.Errorf("projects are not supported for %s", lang)
+	}
+
+	if compile != nil {
+		compile = append(compile, expandFlags(opt.CompileFlags, flags.Compile)...)
+		out, ok, err := dm.compileInSandbox(opt, dir, compile)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("failed to compile %s project", lang)
+			rewriter := newSourceRewriter(opt)
+			return nil, &CompileError{
+				Output:      rewriter.Rewrite(out),
+				Diagnostics: rewriter.RewriteDiagnostics(parseDiagnostics(lang, out)),
+			}
+		}
+	}
+
+	return run, nil
+}
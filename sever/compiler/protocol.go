@@ -0,0 +1,424 @@
+package compiler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const (
+	PROTOCOL_LEGACY  = "legacy"
+	PROTOCOL_V1      = "ide.v1"
+	PROTOCOL_VERSION = 1
+)
+
+// Server -> client message types
+const (
+	MSG_READY       = "ready"
+	MSG_OUTPUT      = "output"
+	MSG_ERROR       = "error"
+	MSG_EXIT        = "exit"
+	MSG_KILLED      = "killed"
+	MSG_TRUNCATED   = "truncated"
+	MSG_DIAGNOSTICS = "diagnostics"
+	MSG_QUEUED      = "queued"
+)
+
+// Client -> server message types
+const (
+	MSG_RUN    = "run"
+	MSG_STDIN  = "stdin"
+	MSG_STOP   = "stop"
+	MSG_RESIZE = "resize"
+	MSG_SIGNAL = "signal"
+	MSG_EOF    = "eof"
+	MSG_CLOSE  = "close"
+	MSG_ACK    = "ack"
+	MSG_CHECK  = "check"
+)
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+const (
+	EXIT_REASON_EXITED        = "exited"
+	EXIT_REASON_SIGNALLED     = "signalled"
+	EXIT_REASON_OOM           = "oom"
+	EXIT_REASON_TIMEOUT       = "timeout"
+	EXIT_REASON_CPU_LIMIT     = "cpu_limit"
+	EXIT_REASON_OUTPUT_LIMIT  = "output_limit"
+	EXIT_REASON_MEMORY_LIMIT  = "memory_limit"
+	EXIT_REASON_USER_STOP     = "user_stop"
+	EXIT_REASON_DISCONNECT    = "disconnect"
+	EXIT_REASON_COMPILE_ERROR = "compile_error"
+)
+
+// Envelope is the wire format of every message in the ide.v1 protocol.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	RunID   string          `json:"run_id,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ReadyPayload struct {
+	ContainerID string `json:"container_id"`
+	Language    string `json:"language"`
+	Protocol    string `json:"protocol"`
+	SessionID   string `json:"session_id"`
+	Resumed     bool   `json:"resumed"`
+	Missed      uint64 `json:"missed,omitempty"`
+}
+
+type OutputPayload struct {
+	Stream   string `json:"stream"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+type KillPayload struct {
+	Reason    string `json:"reason"`
+	Signal    string `json:"signal,omitempty"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// QueuedPayload tells where a compile waits in the queue, 0 once it started.
+type QueuedPayload struct {
+	Position int `json:"position"`
+}
+
+type TruncatedPayload struct {
+	MaxBytes   int64  `json:"max_bytes"`
+	MaxLines   int64  `json:"max_lines"`
+	ArtifactID string `json:"artifact_id,omitempty"`
+}
+
+type RunPayload struct {
+	Source
+	Args  []string `json:"args,omitempty"`
+	Flags RunFlags `json:"flags"`
+	// Optional, the run summary is POSTed here when the run ends
+	Callback *Callback `json:"callback,omitempty"`
+	Limits   RunLimits `json:"limits"`
+	Tty      bool      `json:"tty"`
+	Cols     uint      `json:"cols,omitempty"`
+	Rows     uint      `json:"rows,omitempty"`
+	// Stream only up to the output caps but keep the full output as a
+	// downloadable artifact
+	SpillOutput bool `json:"spill_output"`
+}
+
+// RunLimits are optional client requested limits, they can only lower the
+// language defaults.
+type RunLimits struct {
+	WallTimeMs  int64 `json:"wall_time_ms,omitempty"`
+	CPUTimeMs   int64 `json:"cpu_time_ms,omitempty"`
+	OutputBytes int64 `json:"output_bytes,omitempty"`
+	OutputLines int64 `json:"output_lines,omitempty"`
+	MemoryBytes int64 `json:"memory_bytes,omitempty"`
+}
+
+// CheckPayload asks for the code to be compiled without running it.
+type CheckPayload struct {
+	Source
+	Flags RunFlags `json:"flags"`
+}
+
+type StdinPayload struct {
+	Data string `json:"data"`
+}
+
+type AckPayload struct {
+	Seq uint64 `json:"seq"`
+}
+
+type ResizePayload struct {
+	Cols uint `json:"cols"`
+	Rows uint `json:"rows"`
+}
+
+type SignalPayload struct {
+	Signal string `json:"signal"`
+}
+
+// ClientMessage is a decoded client message, independent of the protocol it arrived in.
+type ClientMessage struct {
+	Type    string
+	RunID   string
+	Payload json.RawMessage
+}
+
+func (m ClientMessage) Decode(v any) error {
+	if len(m.Payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%w: bad %s payload: %v", ErrInvalidMessage, m.Type, err)
+	}
+	return nil
+}
+
+const (
+	// A write that takes longer means the client is gone, like a half open
+	// connection after a network blip
+	CLIENT_WRITE_TIMEOUT = 10 * time.Second
+	// Room for a ready message and a full session replay
+	CLIENT_QUEUE_FRAMES = SESSION_BUFFER_MESSAGES + 1
+)
+
+var ErrClientClosed = errors.New("connection closed")
+
+type clientFrame struct {
+	messageType int
+	data        []byte
+}
+
+// ClientConn wraps a websocket connection and speaks either the JSON envelope
+// protocol or the legacy string protocol. Writes are queued and written by a
+// goroutine of the connection, so callers never wait on the network while
+// holding their locks. A write past CLIENT_WRITE_TIMEOUT closes the
+// connection.
+type ClientConn struct {
+	conn     *websocket.Conn
+	protocol string
+
+	frames    chan clientFrame
+	closed    chan struct{}
+	drain     chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	drainOnce sync.Once
+}
+
+// NegotiateProtocol picks the protocol from the negotiated websocket
+// subprotocol, falling back to the "version" query parameter.
+func NegotiateProtocol(subprotocol, version string) string {
+	if subprotocol == PROTOCOL_V1 || version == "1" {
+		return PROTOCOL_V1
+	}
+	return PROTOCOL_LEGACY
+}
+
+// NewClientConn starts the writer of the connection. The handler must call
+// Drain before it returns.
+func NewClientConn(conn *websocket.Conn, protocol string) *ClientConn {
+	cc := &ClientConn{
+		conn:     conn,
+		protocol: protocol,
+		frames:   make(chan clientFrame, CLIENT_QUEUE_FRAMES),
+		closed:   make(chan struct{}),
+		drain:    make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go cc.writeLoop()
+	return cc
+}
+
+func (cc *ClientConn) Protocol() string {
+	return cc.protocol
+}
+
+// Send writes a connection level message that is not part of the session's
+// numbered stream.
+func (cc *ClientConn) Send(msgType, runID string, payload any) error {
+	return cc.write(msgType, runID, 0, payload)
+}
+
+// write encodes the message and queues it. It only blocks while the queue is
+// full, which the write timeout bounds.
+func (cc *ClientConn) write(msgType, runID string, seq uint64, payload any) error {
+	var frame clientFrame
+	if cc.protocol == PROTOCOL_LEGACY {
+		messageType, data, ok := legacyFrame(payload)
+		if !ok {
+			return nil
+		}
+		frame = clientFrame{messageType, data}
+	} else {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encode payload: %w", err)
+		}
+
+		data, err := json.Marshal(Envelope{
+			Version: PROTOCOL_VERSION,
+			Type:    msgType,
+			RunID:   runID,
+			Seq:     seq,
+			Payload: raw,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		frame = clientFrame{websocket.TextMessage, data}
+	}
+
+	select {
+	case <-cc.closed:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case cc.frames <- frame:
+		return nil
+	case <-cc.closed:
+		return ErrClientClosed
+	}
+}
+
+func (cc *ClientConn) writeLoop() {
+	defer close(cc.stopped)
+
+	for {
+		select {
+		case frame := <-cc.frames:
+			if err := cc.writeFrame(frame); err != nil {
+				return
+			}
+		case <-cc.closed:
+			return
+		case <-cc.drain:
+			for {
+				select {
+				case frame := <-cc.frames:
+					if err := cc.writeFrame(frame); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (cc *ClientConn) writeFrame(frame clientFrame) error {
+	err := cc.conn.SetWriteDeadline(time.Now().Add(CLIENT_WRITE_TIMEOUT))
+	if err == nil {
+		err = cc.conn.WriteMessage(frame.messageType, frame.data)
+	}
+	if err != nil {
+		cc.Close()
+	}
+	return err
+}
+
+func (cc *ClientConn) SendError(runID string, err error) error {
+	return cc.Send(MSG_ERROR, runID, ErrorPayload{Message: err.Error()})
+}
+
+// Close drops the connection and whatever is still queued for it.
+func (cc *ClientConn) Close() error {
+	var err error
+	cc.closeOnce.Do(func() {
+		close(cc.closed)
+		err = cc.conn.Close()
+	})
+	return err
+}
+
+// Drain writes what is still queued and closes the connection. The websocket
+// handler calls it before returning, the connection can't be used after.
+func (cc *ClientConn) Drain() {
+	cc.drainOnce.Do(func() { close(cc.drain) })
+	<-cc.stopped
+	cc.Close()
+}
+
+func (cc *ClientConn) Read() (ClientMessage, error) {
+	typ, msg, err := cc.conn.ReadMessage()
+	if err != nil {
+		return ClientMessage{}, err
+	}
+	if typ == websocket.CloseMessage {
+		return ClientMessage{}, fmt.Errorf("connection closed")
+	}
+
+	if cc.protocol == PROTOCOL_LEGACY {
+		return parseLegacyMessage(msg), nil
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return ClientMessage{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if env.Version > PROTOCOL_VERSION {
+		return ClientMessage{}, fmt.Errorf("%w: unsupported protocol version %d", ErrInvalidMessage, env.Version)
+	}
+	if env.Type == "" {
+		return ClientMessage{}, fmt.Errorf("%w: message type missing", ErrInvalidMessage)
+	}
+
+	return ClientMessage{
+		Type:    env.Type,
+		RunID:   env.RunID,
+		Payload: env.Payload,
+	}, nil
+}
+
+func parseLegacyMessage(msg []byte) ClientMessage {
+	strMsg := string(msg)
+
+	if strings.HasPrefix(strMsg, "CODE:") {
+		payload, _ := json.Marshal(RunPayload{Source: Source{Code: strings.TrimPrefix(strMsg, "CODE:")}})
+		return ClientMessage{Type: MSG_RUN, Payload: payload}
+	}
+	if strMsg == "STOP" {
+		return ClientMessage{Type: MSG_STOP}
+	}
+
+	// Legacy clients send input line by line without the trailing newline
+	payload, _ := json.Marshal(StdinPayload{Data: strMsg + "\n"})
+	return ClientMessage{Type: MSG_STDIN, Payload: payload}
+}
+
+func legacyFrame(payload any) (int, []byte, bool) {
+	switch p := payload.(type) {
+	case ReadyPayload:
+		return websocket.TextMessage, []byte("container_id: " + p.ContainerID), true
+	case OutputPayload:
+		// Raw program output goes out as a binary frame when it is not valid text
+		if p.Encoding == ENCODING_BASE64 {
+			return websocket.BinaryMessage, p.Bytes(), true
+		}
+		return websocket.TextMessage, []byte(p.Data), true
+	case ErrorPayload:
+		return websocket.TextMessage, []byte("error: " + p.Message), true
+	case TruncatedPayload:
+		return websocket.TextMessage, []byte(fmt.Sprintf("\n[output truncated after %d bytes or %d lines]\n", p.MaxBytes, p.MaxLines)), true
+	case RunSummary:
+		if p.Reason == EXIT_REASON_TIMEOUT || p.Reason == EXIT_REASON_CPU_LIMIT {
+			return websocket.TextMessage, []byte("EXEC_TIMEOUT"), true
+		}
+		return websocket.TextMessage, []byte("EXEC_TERMINATED"), true
+	}
+	return 0, nil, false
+}
+
+func newID() string {
+	return randomHex(8)
+}
+
+// newToken returns an unguessable id for things that grant access, like sessions.
+func newToken() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
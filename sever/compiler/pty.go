@@ -0,0 +1,72 @@
+package compiler
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// Signals a client may send to its running program
+var forwardedSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// In PTY mode these go through the terminal's line discipline like real
+// keystrokes, so they reach the foreground process group.
+var ttyControlChars = map[string]string{
+	"SIGINT":  "\x03",
+	"SIGQUIT": "\x1c",
+}
+
+const TTY_EOF = "\x04"
+
+func (dm *DockerManager) resizeExec(ctx context.Context, r *liveRun, size ResizePayload) error {
+	if size.Cols == 0 || size.Rows == 0 {
+		return fmt.Errorf("%w: terminal size must be positive", ErrInvalidMessage)
+	}
+	return dm.cli.ContainerExecResize(ctx, r.execID, container.ResizeOptions{
+		Height: size.Rows,
+		Width:  size.Cols,
+	})
+}
+
+func (dm *DockerManager) forwardSignal(containerID string, r *liveRun, spec execSpec, hijackedResp types.HijackedResponse, name string) error {
+	sig, ok := forwardedSignals[name]
+	if !ok {
+		return fmt.Errorf("%w: signal %q not allowed", ErrInvalidMessage, name)
+	}
+
+	if ch, ok := ttyControlChars[name]; ok && spec.tty {
+		_, err := hijackedResp.Conn.Write([]byte(ch))
+		return err
+	}
+
+	dm.trackPid(context.Background(), r)
+	r.mu.Lock()
+	pid := r.pid
+	r.mu.Unlock()
+	if pid == 0 {
+		return fmt.Errorf("program not started yet")
+	}
+
+	dm.signalTree(containerID, pid, sig)
+	return nil
+}
+
+// closeStdin signals end of input: Ctrl-D on a terminal, a half-close otherwise.
+func closeStdin(spec execSpec, hijackedResp types.HijackedResponse) error {
+	if spec.tty {
+		_, err := hijackedResp.Conn.Write([]byte(TTY_EOF))
+		return err
+	}
+	return hijackedResp.CloseWrite()
+}
@@ -0,0 +1,129 @@
+package compiler
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Generated files under the code and compiled dirs, and the bare
+	// generated file names: <id or time>-<nanos>-code.<ext>
+	internalPath = regexp.MustCompile(`(?:` + regexp.QuoteMeta(CODE_FILES_DIR) + `|` + regexp.QuoteMeta(COMPILED_FILES) +
+		`)/[\w.\-/]*|\b(?:[0-9a-f]{16,}|\d{4}-\d\d-\d\d_\d\d-\d\d-\d\d)-\d{15,}-code\.\w+`)
+	internalLocation = regexp.MustCompile(`(` + internalPath.String() + `)(:\d+)?`)
+	// The source excerpt gcc prints under a diagnostic: "   10 |     return 0"
+	gccGutter = regexp.MustCompile(`(?m)^( *)(\d+)( \|)`)
+)
+
+// sourceRewriter makes compiler and runtime messages point at the code the
+// user wrote: generated paths become the friendly source name and line
+// numbers skip the preamble the server injected.
+type sourceRewriter struct {
+	sourceName string
+	sourceExt  string
+	lineOffset int
+}
+
+func newSourceRewriter(opt LangOptions) *sourceRewriter {
+	return &sourceRewriter{
+		sourceName: opt.SourceName,
+		sourceExt:  filepath.Ext(opt.SourceName),
+		lineOffset: strings.Count(opt.Preamble, "\n"),
+	}
+}
+
+// friendlyName maps a generated file to what the user knows it as. Project
+// files keep the path the user gave them.
+func (r *sourceRewriter) friendlyName(path string) string {
+	if loc := workspacePath.FindStringIndex(path); loc != nil {
+		return path[loc[1]:]
+	}
+	ext := filepath.Ext(path)
+	switch {
+	case ext == r.sourceExt:
+		return r.sourceName
+	case ext == "" || ext == ".out":
+		return strings.TrimSuffix(r.sourceName, r.sourceExt)
+	default:
+		return strings.TrimSuffix(r.sourceName, r.sourceExt) + ext
+	}
+}
+
+// line maps a line of the compiled source to the line the user wrote.
+// Lines in the preamble map to the first line.
+func (r *sourceRewriter) line(n int) int {
+	return max(n-r.lineOffset, 1)
+}
+
+// shifted reports whether the preamble was prepended to the file, projects
+// get it as a file of its own.
+func (r *sourceRewriter) shifted(path string) bool {
+	return r.lineOffset > 0 && filepath.Ext(path) == r.sourceExt && !workspacePath.MatchString(path)
+}
+
+// Rewrite rewrites compiler or runtime output.
+func (r *sourceRewriter) Rewrite(s string) string {
+	if r == nil || r.sourceName == "" {
+		return s
+	}
+	return internalLocation.ReplaceAllStringFunc(s, func(match string) string {
+		m := internalLocation.FindStringSubmatch(match)
+		name := r.friendlyName(m[1])
+		if m[2] == "" {
+			return name
+		}
+		n, err := strconv.Atoi(m[2][1:])
+		if err != nil || !r.shifted(m[1]) {
+			return name + m[2]
+		}
+		return name + ":" + strconv.Itoa(r.line(n))
+	})
+}
+
+// RewriteCompileOutput also renumbers the source excerpts gcc prints under
+// the diagnostics of the user's file. Excerpts of other files, like system
+// headers, keep their numbers.
+func (r *sourceRewriter) RewriteCompileOutput(s string) string {
+	if r == nil || r.lineOffset == 0 {
+		return r.Rewrite(s)
+	}
+
+	lines := strings.Split(s, "\n")
+	inSource := false
+	for i, line := range lines {
+		if m := gccDiagnostic.FindStringSubmatch(line); m != nil {
+			inSource = r.shifted(m[1])
+			continue
+		}
+		if !inSource {
+			continue
+		}
+		lines[i] = gccGutter.ReplaceAllStringFunc(line, func(match string) string {
+			m := gccGutter.FindStringSubmatch(match)
+			n, _ := strconv.Atoi(m[2])
+			// Keep the gutter as wide as before so the caret lines still align
+			width := len(m[1]) + len(m[2])
+			return fmt.Sprintf("%*d", width, r.line(n)) + m[3]
+		})
+	}
+	return r.Rewrite(strings.Join(lines, "\n"))
+}
+
+func (r *sourceRewriter) RewriteDiagnostics(diagnostics []Diagnostic) []Diagnostic {
+	for i := range diagnostics {
+		d := &diagnostics[i]
+		if r.shifted(d.File) && d.Line > 0 {
+			d.Line = r.line(d.Line)
+		}
+		d.File = r.Rewrite(d.File)
+		d.Message = r.Rewrite(d.Message)
+	}
+	return diagnostics
+}
+
+func (r *sourceRewriter) rewriteBytes(p []byte) []byte {
+	return []byte(r.Rewrite(string(p)))
+}
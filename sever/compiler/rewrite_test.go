@@ -0,0 +1,155 @@
+package compiler
+
+import (
+	"slices"
+	"testing"
+)
+
+const (
+	testCFile  = COMPILED_FILES + "/0123456789abcdef-1760000000000000000-code.c"
+	testPyFile = COMPILED_FILES + "/2026-10-16_12-30-00-1760000000000000000-code.py"
+)
+
+func TestSourceRewriterRewrite(t *testing.T) {
+	c := newSourceRewriter(LangImages["c"])
+	py := newSourceRewriter(LangImages["py"])
+	tests := []struct {
+		name string
+		r    *sourceRewriter
+		in   string
+		want string
+	}{
+		{
+			name: "compile error location",
+			r:    c,
+			in:   testCFile + ":12:5: error: expected ';'",
+			want: "main.c:4:5: error: expected ';'",
+		},
+		{
+			name: "line in the preamble",
+			r:    c,
+			in:   testCFile + ":3: warning: x",
+			want: "main.c:1: warning: x",
+		},
+		{
+			name: "binary",
+			r:    c,
+			in:   "/bin/sh: " + COMPILED_FILES + "/0123456789abcdef-1760000000000000000-code.out: not found",
+			want: "/bin/sh: main: not found",
+		},
+		{
+			name: "system header keeps its line",
+			r:    c,
+			in:   "/usr/include/stdio.h:356:12: note: expected 'const char *'",
+			want: "/usr/include/stdio.h:356:12: note: expected 'const char *'",
+		},
+		{
+			name: "project file keeps its path and line",
+			r:    c,
+			in:   COMPILED_FILES + "/ws-0a1b2c/src/util.c:12:1: error: x",
+			want: "src/util.c:12:1: error: x",
+		},
+		{
+			name: "python traceback",
+			r:    py,
+			in:   "  File \"" + testPyFile + "\", line 3, in <module>",
+			want: "  File \"main.py\", line 3, in <module>",
+		},
+		{
+			name: "bare generated name",
+			r:    py,
+			in:   "2026-10-16_12-30-00-1760000000000000000-code.py:3: SyntaxWarning",
+			want: "main.py:3: SyntaxWarning",
+		},
+		{
+			name: "program output that looks like a file name",
+			r:    c,
+			in:   "cannot open qr-code.png\nsee bar-code.c:4 and 2024-code.txt",
+			want: "cannot open qr-code.png\nsee bar-code.c:4 and 2024-code.txt",
+		},
+		{
+			name: "nil rewriter",
+			r:    nil,
+			in:   testCFile + ":12",
+			want: testCFile + ":12",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Rewrite(tt.in); got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceRewriterCompileOutput(t *testing.T) {
+	c := newSourceRewriter(LangImages["c"])
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "user excerpt",
+			in: testCFile + ":12:17: error: expected ';' before 'return'\n" +
+				"   12 |     printf(\"hi\")\n" +
+				"      |                 ^\n" +
+				"   13 |     return 0;\n",
+			want: "main.c:4:17: error: expected ';' before 'return'\n" +
+				"    4 |     printf(\"hi\")\n" +
+				"      |                 ^\n" +
+				"    5 |     return 0;\n",
+		},
+		{
+			name: "system header excerpt",
+			in: testCFile + ":10:12: warning: passing argument 1 of 'puts' makes pointer from integer\n" +
+				"   10 |     puts(42);\n" +
+				"In file included from " + testCFile + ":1:\n" +
+				"/usr/include/stdio.h:356:12: note: expected 'const char *' but argument is of type 'int'\n" +
+				"  356 | extern int puts (const char *__s);\n" +
+				"      |                  ~~~~~~~~~~~~^~~\n",
+			want: "main.c:2:12: warning: passing argument 1 of 'puts' makes pointer from integer\n" +
+				"    2 |     puts(42);\n" +
+				"In file included from main.c:1:\n" +
+				"/usr/include/stdio.h:356:12: note: expected 'const char *' but argument is of type 'int'\n" +
+				"  356 | extern int puts (const char *__s);\n" +
+				"      |                  ~~~~~~~~~~~~^~~\n",
+		},
+		{
+			name: "no diagnostic before the excerpt",
+			in:   "   12 | stray\n",
+			want: "   12 | stray\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.RewriteCompileOutput(tt.in); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	cpp := newSourceRewriter(LangImages["cpp"])
+	in := COMPILED_FILES + "/0123456789abcdef-1760000000000000000-code.cpp:12:1: error: x\n   12 | y\n"
+	if got, want := cpp.RewriteCompileOutput(in), "main.cpp:12:1: error: x\n   12 | y\n"; got != want {
+		t.Errorf("without a preamble got %q, want %q", got, want)
+	}
+}
+
+func TestSourceRewriterDiagnostics(t *testing.T) {
+	c := newSourceRewriter(LangImages["c"])
+	got := c.RewriteDiagnostics([]Diagnostic{
+		{File: testCFile, Line: 12, Column: 5, Message: "'x' undeclared"},
+		{File: "/usr/include/stdio.h", Line: 356, Message: "declared in " + testCFile},
+		{File: COMPILED_FILES + "/ws-0a1b2c/lib.c", Line: 3},
+	})
+	want := []Diagnostic{
+		{File: "main.c", Line: 4, Column: 5, Message: "'x' undeclared"},
+		{File: "/usr/include/stdio.h", Line: 356, Message: "declared in main.c"},
+		{File: "lib.c", Line: 3},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
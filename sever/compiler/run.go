@@ -0,0 +1,374 @@
+package compiler
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	RUN_SAMPLE_INTERVAL = 100 * time.Millisecond
+	EXEC_INSPECT_WAIT   = 2 * time.Second
+)
+
+// RunSummary is sent as the final message of every run. CPU time and memory
+// are sampled from the host's /proc while the program runs.
+type RunSummary struct {
+	ExitCode        int    `json:"exit_code"`
+	Reason          string `json:"reason"`
+	Signal          int    `json:"signal,omitempty"`
+	WallTimeMs      int64  `json:"wall_time_ms"`
+	CPUTimeMs       int64  `json:"cpu_time_ms"`
+	PeakMemoryBytes int64  `json:"peak_memory_bytes"`
+	OutputBytes     int64  `json:"output_bytes"`
+	Truncated       bool   `json:"truncated,omitempty"`
+	ArtifactID      string `json:"artifact_id,omitempty"`
+}
+
+type execSpec struct {
+	runID     string
+	cmd       []string
+	wallLimit time.Duration
+	cpuLimit  time.Duration
+	memLimit  int64
+	tty       bool
+	size      ResizePayload
+	limits    RunLimits
+	spill     bool
+	callback  *Callback
+}
+
+// applyLimits resolves the requested limits, never going above the language
+// maximum.
+func (spec *execSpec) applyLimits(opt LangOptions) {
+	l := spec.limits
+
+	spec.wallLimit = opt.WallTimeLimit
+	if req := time.Duration(l.WallTimeMs) * time.Millisecond; req > 0 && req < spec.wallLimit {
+		spec.wallLimit = req
+	}
+	spec.cpuLimit = opt.CPUTimeLimit
+	if req := time.Duration(l.CPUTimeMs) * time.Millisecond; req > 0 && req < spec.cpuLimit {
+		spec.cpuLimit = req
+	}
+	spec.memLimit = opt.MaxMem
+	if l.MemoryBytes > 0 && l.MemoryBytes < spec.memLimit {
+		spec.memLimit = l.MemoryBytes
+	}
+}
+
+// capWallTime lowers the wall limit to what is left until deadline, unless
+// deadline is zero, and reports whether the deadline now bounds the run.
+func (spec *execSpec) capWallTime(deadline time.Time) bool {
+	if deadline.IsZero() {
+		return false
+	}
+	left := time.Until(deadline)
+	if left >= spec.wallLimit {
+		return false
+	}
+	spec.wallLimit = max(left, 0)
+	return true
+}
+
+// execution is a started exec whose output is pumped into a sender.
+type execution struct {
+	containerID  string
+	spec         execSpec
+	run          *liveRun
+	hijackedResp types.HijackedResponse
+	limiter      *outputLimiter
+	ctx          context.Context
+	cancel       context.CancelFunc
+	outputDone   chan struct{}
+}
+
+type liveRun struct {
+	id      string
+	execID  string
+	started time.Time
+
+	mu         sync.Mutex
+	pid        int
+	reason     string
+	cpuTime    time.Duration
+	peakMemory int64
+	oomFile    string
+	oomBefore  int64
+}
+
+func newLiveRun(id, execID string) *liveRun {
+	return &liveRun{
+		id:      id,
+		execID:  execID,
+		started: time.Now(),
+	}
+}
+
+// setReason records why the server ended the run. The first reason wins.
+func (r *liveRun) setReason(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reason == "" {
+		r.reason = reason
+	}
+}
+
+// sample updates the resource usage of the run and returns the usage so far.
+func (r *liveRun) sample() procUsage {
+	r.mu.Lock()
+	pid := r.pid
+	r.mu.Unlock()
+	if pid == 0 {
+		return procUsage{}
+	}
+
+	usage := treeUsage(pid)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cpuTime = max(r.cpuTime, usage.cpuTime)
+	r.peakMemory = max(r.peakMemory, usage.memory)
+	return procUsage{cpuTime: r.cpuTime, memory: r.peakMemory}
+}
+
+// trackPid looks up the host pid of the exec and remembers the cgroup oom
+// counter so an OOM kill during the run can be recognised. It does nothing
+// once the pid is known, so it can be retried until the exec reports one.
+func (dm *DockerManager) trackPid(ctx context.Context, r *liveRun) {
+	r.mu.Lock()
+	known := r.pid != 0
+	r.mu.Unlock()
+	if known {
+		return
+	}
+
+	inspect, err := dm.cli.ContainerExecInspect(ctx, r.execID)
+	if err != nil || inspect.Pid == 0 {
+		return
+	}
+
+	oomFile := oomEventsFile(inspect.Pid)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pid = inspect.Pid
+	r.oomFile = oomFile
+	r.oomBefore = readOOMKills(oomFile)
+}
+
+func (dm *DockerManager) finishRun(r *liveRun) RunSummary {
+	wall := time.Since(r.started)
+	r.sample()
+
+	summary := RunSummary{ExitCode: -1}
+
+	deadline := time.Now().Add(EXEC_INSPECT_WAIT)
+	for {
+		inspect, err := dm.cli.ContainerExecInspect(context.Background(), r.execID)
+		if err != nil {
+			break
+		}
+		if !inspect.Running {
+			summary.ExitCode = inspect.ExitCode
+			break
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	summary.WallTimeMs = wall.Milliseconds()
+	summary.CPUTimeMs = r.cpuTime.Milliseconds()
+	summary.PeakMemoryBytes = r.peakMemory
+
+	if summary.ExitCode > 128 {
+		summary.Signal = summary.ExitCode - 128
+	}
+
+	switch {
+	case r.reason != "":
+		summary.Reason = r.reason
+	case summary.Signal == 9 && r.oomFile != "" && readOOMKills(r.oomFile) > r.oomBefore:
+		summary.Reason = EXIT_REASON_OOM
+	case summary.Signal != 0:
+		summary.Reason = EXIT_REASON_SIGNALLED
+	default:
+		summary.Reason = EXIT_REASON_EXITED
+	}
+
+	return summary
+}
+
+// enforceLimits samples the run and ends it once the wall clock, cpu time or
+// memory limit is exceeded. The wall clock timer is armed once for the whole run.
+func (dm *DockerManager) enforceLimits(ctx context.Context, cancel context.CancelFunc, r *liveRun, spec execSpec) {
+	wallTimer := time.NewTimer(spec.wallLimit)
+	defer wallTimer.Stop()
+	ticker := time.NewTicker(RUN_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wallTimer.C:
+			r.setReason(EXIT_REASON_TIMEOUT)
+			cancel()
+			return
+		case <-ticker.C:
+			// In case the pid was not reported yet when the exec started
+			dm.trackPid(ctx, r)
+			usage := r.sample()
+			if spec.cpuLimit > 0 && usage.cpuTime >= spec.cpuLimit {
+				r.setReason(EXIT_REASON_CPU_LIMIT)
+				cancel()
+				return
+			}
+			if spec.memLimit > 0 && usage.memory > spec.memLimit {
+				r.setReason(EXIT_REASON_MEMORY_LIMIT)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// startExec creates and attaches the exec for spec and starts streaming its
+// output to out and enforcing its limits. throttle, if set, is called before
+// every chunk of output so a slow receiver can hold the program back.
+func (dm *DockerManager) startExec(containerID string, opt LangOptions, spec execSpec, out messageSender, throttle func(context.Context) error) (*execution, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	execConfig := container.ExecOptions{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          spec.tty,
+		Cmd:          spec.cmd,
+		User:         "nobody",
+		Env:          opt.Env,
+		WorkingDir:   "/tmp",
+		Privileged:   false,
+	}
+
+	if spec.tty && spec.size.Cols > 0 && spec.size.Rows > 0 {
+		execConfig.ConsoleSize = &[2]uint{spec.size.Rows, spec.size.Cols}
+	}
+
+	execResp, err := dm.cli.ContainerExecCreate(ctx, containerID, execConfig)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	hijackedResp, err := dm.cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{Tty: spec.tty})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	run := newLiveRun(spec.runID, execResp.ID)
+	// Right away, a program that dies before the first sample still needs
+	// its pid and the oom counter from before it ran
+	dm.trackPid(ctx, run)
+
+	limiter, err := newOutputLimiter(spec.limits, spec.spill, func() {
+		run.setReason(EXIT_REASON_OUTPUT_LIMIT)
+		cancel()
+	})
+	if err != nil {
+		hijackedResp.Close()
+		cancel()
+		return nil, err
+	}
+
+	e := &execution{
+		containerID:  containerID,
+		spec:         spec,
+		run:          run,
+		hijackedResp: hijackedResp,
+		limiter:      limiter,
+		ctx:          ctx,
+		cancel:       cancel,
+		outputDone:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(e.outputDone)
+		stdout := newStreamWriter(out, spec.runID, STREAM_STDOUT)
+		stderr := newStreamWriter(out, spec.runID, STREAM_STDERR)
+		for _, w := range []*streamWriter{stdout, stderr} {
+			w.limiter = limiter
+			if throttle != nil {
+				w.throttle = func() error { return throttle(ctx) }
+			}
+		}
+
+		// Stack traces go to stderr, which a TTY merges into stdout.
+		// Chunks are rewritten as they come, a trace line split across
+		// reads keeps its raw path
+		rewriter := newSourceRewriter(opt)
+		if spec.tty {
+			stdout.rewrite = rewriter.rewriteBytes
+		} else {
+			stderr.rewrite = rewriter.rewriteBytes
+		}
+		defer stdout.Flush()
+		defer stderr.Flush()
+
+		// A TTY merges both streams, without one docker multiplexes them
+		// behind 8-byte frame headers
+		var err error
+		if spec.tty {
+			_, err = io.Copy(stdout, hijackedResp.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(stdout, stderr, hijackedResp.Reader)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("read error: %v", err)
+		}
+	}()
+
+	go dm.enforceLimits(ctx, cancel, run, spec)
+
+	return e, nil
+}
+
+// finishExec kills the program if the server ended the run, waits for the
+// remaining output and returns the run summary.
+func (dm *DockerManager) finishExec(e *execution, out messageSender) RunSummary {
+	e.cancel()
+
+	e.run.mu.Lock()
+	reason := e.run.reason
+	e.run.mu.Unlock()
+
+	if reason != "" {
+		signal, confirmed := dm.killRun(e.containerID, e.run)
+		out.Send(MSG_KILLED, e.spec.runID, KillPayload{Reason: reason, Signal: signal, Confirmed: confirmed})
+	}
+
+	// Let the output drain to EOF, unless the process survived the kill
+	select {
+	case <-e.outputDone:
+	case <-time.After(time.Second):
+		e.hijackedResp.Close()
+		<-e.outputDone
+	}
+	e.hijackedResp.Close()
+
+	summary := dm.finishRun(e.run)
+	summary.OutputBytes, summary.Truncated, summary.ArtifactID = e.limiter.close()
+	return summary
+}
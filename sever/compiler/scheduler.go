@@ -0,0 +1,183 @@
+package compiler
+
+import (
+	"log"
+	"sync"
+)
+
+// COMPILE_WORKERS is how many compiles of a language run at once unless the
+// language sets MaxCompiles.
+const COMPILE_WORKERS = 2
+
+// compileCaller is who a compile is for. Waiting compiles are served round
+// robin by caller so one busy session can't starve the others.
+type compileCaller struct {
+	id string
+	// Optional, told the place in the queue while waiting and 0 once the
+	// compile starts
+	onQueued func(position int)
+}
+
+type compileTicket struct {
+	ready    chan struct{}
+	onQueued func(position int)
+	position int
+}
+
+// compileQueue is the queue of one language.
+type compileQueue struct {
+	limit   int
+	running int
+	callers []string // callers with waiting tickets, in serving order
+	waiting map[string][]*compileTicket
+}
+
+// compileFlight is a compile in progress that identical requests wait for.
+type compileFlight struct {
+	done chan struct{}
+	run  []string
+	err  error
+}
+
+// compileScheduler bounds the compiles running per language and coalesces
+// identical ones.
+type compileScheduler struct {
+	mu       sync.Mutex
+	queues   map[string]*compileQueue
+	inflight map[string]*compileFlight
+}
+
+type positionUpdate struct {
+	onQueued func(int)
+	position int
+}
+
+func newCompileScheduler() *compileScheduler {
+	return &compileScheduler{
+		queues:   make(map[string]*compileQueue),
+		inflight: make(map[string]*compileFlight),
+	}
+}
+
+// Do runs build for key, or waits for the build of key already in flight and
+// shares its result.
+func (s *compileScheduler) Do(lang, key string, caller compileCaller, build func() ([]string, error)) ([]string, error) {
+	s.mu.Lock()
+	if f, ok := s.inflight[key]; ok {
+		s.mu.Unlock()
+		log.Printf("waiting for identical %s compile: %s", lang, key)
+		<-f.done
+		return append([]string(nil), f.run...), f.err
+	}
+	f := &compileFlight{done: make(chan struct{})}
+	s.inflight[key] = f
+	s.mu.Unlock()
+
+	s.acquire(lang, caller)
+	f.run, f.err = build()
+	s.release(lang)
+
+	s.mu.Lock()
+	delete(s.inflight, key)
+	s.mu.Unlock()
+	close(f.done)
+
+	return append([]string(nil), f.run...), f.err
+}
+
+func (s *compileScheduler) queue(lang string) *compileQueue {
+	q, ok := s.queues[lang]
+	if !ok {
+		limit := LangImages[lang].MaxCompiles
+		if limit <= 0 {
+			limit = COMPILE_WORKERS
+		}
+		q = &compileQueue{limit: limit, waiting: make(map[string][]*compileTicket)}
+		s.queues[lang] = q
+	}
+	return q
+}
+
+// acquire blocks until the caller may start a compile of lang.
+func (s *compileScheduler) acquire(lang string, caller compileCaller) {
+	s.mu.Lock()
+	q := s.queue(lang)
+	if q.running < q.limit && len(q.callers) == 0 {
+		q.running++
+		s.mu.Unlock()
+		return
+	}
+
+	ticket := &compileTicket{ready: make(chan struct{}), onQueued: caller.onQueued}
+	if len(q.waiting[caller.id]) == 0 {
+		q.callers = append(q.callers, caller.id)
+	}
+	q.waiting[caller.id] = append(q.waiting[caller.id], ticket)
+	updates := q.positions()
+	s.mu.Unlock()
+
+	notify(updates)
+	<-ticket.ready
+}
+
+// release frees a slot of lang and starts the next waiting compiles.
+func (s *compileScheduler) release(lang string) {
+	s.mu.Lock()
+	q := s.queue(lang)
+	q.running--
+
+	var updates []positionUpdate
+	for q.running < q.limit && len(q.callers) > 0 {
+		id := q.callers[0]
+		q.callers = q.callers[1:]
+		ticket := q.waiting[id][0]
+		q.waiting[id] = q.waiting[id][1:]
+		if len(q.waiting[id]) > 0 {
+			q.callers = append(q.callers, id)
+		} else {
+			delete(q.waiting, id)
+		}
+
+		q.running++
+		close(ticket.ready)
+		if ticket.onQueued != nil {
+			updates = append(updates, positionUpdate{ticket.onQueued, 0})
+		}
+	}
+	updates = append(updates, q.positions()...)
+	s.mu.Unlock()
+
+	notify(updates)
+}
+
+// positions works out where every waiting ticket stands in the round robin
+// and returns the ones that moved. Must be called with s.mu held.
+func (q *compileQueue) positions() []positionUpdate {
+	var updates []positionUpdate
+	position := 0
+	for round := 0; ; round++ {
+		served := false
+		for _, id := range q.callers {
+			tickets := q.waiting[id]
+			if round >= len(tickets) {
+				continue
+			}
+			served = true
+			position++
+			ticket := tickets[round]
+			if ticket.position != position && ticket.onQueued != nil {
+				updates = append(updates, positionUpdate{ticket.onQueued, position})
+			}
+			ticket.position = position
+		}
+		if !served {
+			return updates
+		}
+	}
+}
+
+func notify(updates []positionUpdate) {
+	for _, u := range updates {
+		u.onQueued(u.position)
+	}
+}
@@ -0,0 +1,318 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_GRACE_PERIOD    = 2 * time.Minute
+	SESSION_BUFFER_MESSAGES = 1024
+	SESSION_BUFFER_BYTES    = 1024 * 1024
+)
+
+var ErrSessionClosed = errors.New("session closed")
+
+// messageSender is implemented by everything a run can report to.
+type messageSender interface {
+	Send(msgType, runID string, payload any) error
+}
+
+type bufferedMessage struct {
+	msgType string
+	runID   string
+	seq     uint64
+	payload any
+	size    int
+	offset  int64
+}
+
+// Session outlives the websocket connection that created it. The program
+// keeps running while the client is away, output is kept in a bounded ring
+// buffer and replayed when the client reconnects with the session id.
+type Session struct {
+	ID          string
+	Lang        string
+	ContainerID string
+	protocol    string
+
+	dm          *DockerManager
+	sendMu      sync.Mutex // keeps messages in seq order on the wire
+	mu          sync.Mutex
+	client      *ClientConn
+	seq         uint64
+	buffer      []bufferedMessage
+	bufferBytes int
+	graceTimer  *time.Timer
+	flowControl bool
+	flowCond    *sync.Cond
+	sentBytes   int64
+	ackedBytes  int64
+
+	inbox     chan ClientMessage
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// StartSession creates a session on an already assigned container and starts
+// its run loop. The container user is released when the session ends.
+func (dm *DockerManager) StartSession(lang, containerID, protocol string) *Session {
+	s := &Session{
+		ID:          newToken(),
+		Lang:        lang,
+		ContainerID: containerID,
+		protocol:    protocol,
+		dm:          dm,
+		inbox:       make(chan ClientMessage),
+		done:        make(chan struct{}),
+	}
+	s.flowCond = sync.NewCond(&s.mu)
+
+	dm.sessionsMu.Lock()
+	dm.sessions[s.ID] = s
+	dm.sessionsMu.Unlock()
+
+	go func() {
+		if err := dm.RunLiveCode(s); err != nil && !errors.Is(err, ErrSessionClosed) {
+			log.Printf("Interactive session error: %v", err)
+			s.SendError("", err)
+		}
+		s.Close()
+
+		if err := dm.DecreaseUser(containerID); err != nil {
+			log.Printf("Failed to remove container %s: %v", containerID, err)
+		}
+	}()
+
+	return s
+}
+
+func (dm *DockerManager) FindSession(id string) (*Session, error) {
+	dm.sessionsMu.Lock()
+	defer dm.sessionsMu.Unlock()
+
+	s, ok := dm.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %s not found or expired", id)
+	}
+	return s, nil
+}
+
+func (s *Session) Protocol() string {
+	return s.protocol
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// compileCaller queues the compiles of the session as one caller and tells
+// the client where the compile of runID waits.
+func (s *Session) compileCaller(runID string) compileCaller {
+	return compileCaller{
+		id: s.ID,
+		onQueued: func(position int) {
+			s.Send(MSG_QUEUED, runID, QueuedPayload{Position: position})
+		},
+	}
+}
+
+// Send numbers the message, keeps it for replay and forwards it to the
+// attached client. A failed write only means the client is gone, the
+// session itself goes on until the grace period runs out. The client is
+// written to without holding s.mu, so a stalled connection never holds up a
+// reconnect or an ack.
+func (s *Session) Send(msgType, runID string, payload any) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	s.seq++
+	size := messageSize(payload)
+	s.sentBytes += int64(size)
+	msg := bufferedMessage{
+		msgType: msgType,
+		runID:   runID,
+		seq:     s.seq,
+		payload: payload,
+		size:    size,
+		offset:  s.sentBytes,
+	}
+
+	s.buffer = append(s.buffer, msg)
+	s.bufferBytes += msg.size
+	for len(s.buffer) > SESSION_BUFFER_MESSAGES || (s.bufferBytes > SESSION_BUFFER_BYTES && len(s.buffer) > 1) {
+		s.bufferBytes -= s.buffer[0].size
+		s.buffer[0] = bufferedMessage{}
+		s.buffer = s.buffer[1:]
+	}
+	// A client attached after this point gets the message in its replay
+	client := s.client
+	s.mu.Unlock()
+
+	if client != nil {
+		if err := client.write(msg.msgType, msg.runID, msg.seq, msg.payload); err != nil {
+			log.Printf("Failed to send to session %s: %v", s.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Session) SendError(runID string, err error) error {
+	return s.Send(MSG_ERROR, runID, ErrorPayload{Message: err.Error()})
+}
+
+// Serve attaches the client, replays everything after lastSeq and forwards
+// its messages to the run loop until the connection drops.
+func (s *Session) Serve(client *ClientConn, lastSeq uint64) {
+	defer s.detach(client)
+	if err := s.attach(client, lastSeq); err != nil {
+		client.SendError("", err)
+		return
+	}
+
+	for {
+		msg, err := client.Read()
+		if errors.Is(err, ErrInvalidMessage) {
+			client.SendError("", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if msg.Type == MSG_CLOSE {
+			s.Close()
+			return
+		}
+		if msg.Type == MSG_ACK {
+			var ack AckPayload
+			if err := msg.Decode(&ack); err != nil {
+				client.SendError("", err)
+				continue
+			}
+			s.ack(ack.Seq)
+			continue
+		}
+
+		select {
+		case s.inbox <- msg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) attach(client *ClientConn, lastSeq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+	}
+
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+
+	// Only one connection drives a session, a newer one takes over
+	if s.client != nil {
+		s.client.Close()
+	}
+	s.client = client
+
+	var missed uint64
+	var replay []bufferedMessage
+	if len(s.buffer) > 0 && s.buffer[0].seq > lastSeq+1 {
+		missed = s.buffer[0].seq - lastSeq - 1
+	}
+	for _, msg := range s.buffer {
+		if msg.seq > lastSeq {
+			replay = append(replay, msg)
+		}
+	}
+
+	// The queue of a new connection fits the ready message and a full
+	// replay, so this never waits on the network
+	if err := client.Send(MSG_READY, "", ReadyPayload{
+		ContainerID: s.ContainerID,
+		Language:    s.Lang,
+		Protocol:    client.Protocol(),
+		SessionID:   s.ID,
+		Resumed:     lastSeq > 0 || s.seq > 0,
+		Missed:      missed,
+	}); err != nil {
+		return err
+	}
+
+	for _, msg := range replay {
+		if err := client.write(msg.msgType, msg.runID, msg.seq, msg.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) detach(client *ClientConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != client {
+		return
+	}
+	s.client = nil
+
+	// Legacy clients have no way to resume
+	if s.protocol == PROTOCOL_LEGACY {
+		go s.Close()
+		return
+	}
+	s.graceTimer = time.AfterFunc(SESSION_GRACE_PERIOD, s.expire)
+}
+
+func (s *Session) expire() {
+	s.mu.Lock()
+	attached := s.client != nil
+	s.mu.Unlock()
+
+	if !attached {
+		log.Printf("Session %s expired", s.ID)
+		s.Close()
+	}
+}
+
+// Close ends the session, the run loop kills any running program and
+// releases the container.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.dm.sessionsMu.Lock()
+		delete(s.dm.sessions, s.ID)
+		s.dm.sessionsMu.Unlock()
+
+		s.mu.Lock()
+		s.flowCond.Broadcast()
+		if s.graceTimer != nil {
+			s.graceTimer.Stop()
+		}
+		if s.client != nil {
+			s.client.Close()
+			s.client = nil
+		}
+		s.mu.Unlock()
+	})
+}
+
+func messageSize(payload any) int {
+	if p, ok := payload.(OutputPayload); ok {
+		return len(p.Data)
+	}
+	return 64
+}
@@ -0,0 +1,134 @@
+package compiler
+
+import (
+	"encoding/base64"
+	"unicode/utf8"
+)
+
+const (
+	STREAM_STDOUT   = "stdout"
+	STREAM_STDERR   = "stderr"
+	ENCODING_BASE64 = "base64"
+)
+
+// streamWriter turns one demultiplexed stream of an exec into output
+// messages. Text is sent as-is, anything that is not valid UTF-8 is base64
+// encoded so it survives the JSON envelope and text frames.
+type streamWriter struct {
+	client  messageSender
+	runID   string
+	stream  string
+	pending []byte
+
+	// All optional: the output caps of the run, a hook that blocks while
+	// the client is behind and a rewrite of the output, like hiding paths
+	limiter  *outputLimiter
+	throttle func() error
+	rewrite  func([]byte) []byte
+}
+
+func newStreamWriter(client messageSender, runID, stream string) *streamWriter {
+	return &streamWriter{
+		client: client,
+		runID:  runID,
+		stream: stream,
+	}
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	data := p
+	if w.rewrite != nil {
+		data = w.rewrite(data)
+	}
+	var notice *TruncatedPayload
+	if w.limiter != nil {
+		data, notice = w.limiter.admit(data)
+	}
+
+	if len(data) > 0 {
+		if w.throttle != nil {
+			if err := w.throttle(); err != nil {
+				return 0, err
+			}
+		}
+
+		buf := append(w.pending, data...)
+
+		// Hold back a rune split across reads so it is not mistaken for binary
+		cut := len(buf) - incompleteRuneSuffix(buf)
+		w.pending = append([]byte(nil), buf[cut:]...)
+		if cut > 0 {
+			if err := w.client.Send(MSG_OUTPUT, w.runID, newOutputPayload(w.stream, buf[:cut])); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if notice != nil {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+		if err := w.client.Send(MSG_TRUNCATED, w.runID, *notice); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *streamWriter) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	data := w.pending
+	w.pending = nil
+	return w.client.Send(MSG_OUTPUT, w.runID, newOutputPayload(w.stream, data))
+}
+
+func newOutputPayload(stream string, data []byte) OutputPayload {
+	if utf8.Valid(data) {
+		return OutputPayload{Stream: stream, Data: string(data)}
+	}
+	return OutputPayload{
+		Stream:   stream,
+		Data:     base64.StdEncoding.EncodeToString(data),
+		Encoding: ENCODING_BASE64,
+	}
+}
+
+func (p OutputPayload) Bytes() []byte {
+	if p.Encoding == ENCODING_BASE64 {
+		data, err := base64.StdEncoding.DecodeString(p.Data)
+		if err != nil {
+			return []byte(p.Data)
+		}
+		return data
+	}
+	return []byte(p.Data)
+}
+
+// incompleteRuneSuffix returns the length of a trailing, not yet complete
+// UTF-8 sequence in b.
+func incompleteRuneSuffix(b []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < utf8.RuneSelf {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			size := 0
+			switch {
+			case c&0xE0 == 0xC0:
+				size = 2
+			case c&0xF0 == 0xE0:
+				size = 3
+			case c&0xF8 == 0xF0:
+				size = 4
+			}
+			if size > i {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
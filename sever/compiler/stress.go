@@ -0,0 +1,295 @@
+package compiler
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	STRESS_DEFAULT_ITERATIONS = 100
+	STRESS_MAX_ITERATIONS     = 1000
+	STRESS_DEFAULT_MAX_SIZE   = 100
+	STRESS_MAX_SIZE           = 1 << 30 // keeps the sizes from overflowing
+	STRESS_TIME_BUDGET        = 2 * time.Minute
+)
+
+const (
+	STRESS_PASSED          = "passed"
+	STRESS_FAILED          = "failed"
+	STRESS_COMPILE_ERROR   = "compile_error"
+	STRESS_GENERATOR_ERROR = "generator_error"
+	STRESS_REFERENCE_ERROR = "reference_error"
+)
+
+const EVENT_STRESS_COMPLETED = "stress.completed"
+
+// Program is a helper program of a stress test.
+type Program struct {
+	Language string    `json:"language"`
+	Code     string    `json:"code"`
+	Limits   RunLimits `json:"limits"`
+}
+
+// StressRequest compares the solution against a reference on generated
+// inputs. The generator is run as `<program> <seed> <size>` and prints one
+// input on stdout. Sizes grow from 1 to MaxSize over the iterations, so the
+// first failing input found is also the smallest one.
+type StressRequest struct {
+	Language string `json:"language"`
+	Source
+	Flags      RunFlags       `json:"flags"`
+	Reference  Program        `json:"reference"`
+	Generator  Program        `json:"generator"`
+	Iterations int            `json:"iterations"`
+	MaxSize    int            `json:"max_size"`
+	Seed       int64          `json:"seed"`
+	Limits     RunLimits      `json:"limits"`
+	Compare    CompareOptions `json:"compare"`
+	Callback   *Callback      `json:"callback,omitempty"`
+}
+
+// StressResult describes the first failing input, if any. When the time
+// budget runs out first the stress test passes with fewer iterations.
+type StressResult struct {
+	RunID      string `json:"run_id"`
+	Status     string `json:"status"`
+	Iterations int    `json:"iterations"`
+	Seed       int64  `json:"seed"`
+	Message    string `json:"message,omitempty"`
+	// Set when Status is failed
+	Verdict  string         `json:"verdict,omitempty"`
+	Size     int            `json:"size,omitempty"`
+	Input    string         `json:"input,omitempty"`
+	Expected string         `json:"expected,omitempty"`
+	Output   string         `json:"output,omitempty"`
+	Encoding string         `json:"encoding,omitempty"`
+	Run      *ExecuteResult `json:"run,omitempty"`
+}
+
+func (p Program) Validate(name string) error {
+	if _, ok := LangImages[p.Language]; !ok {
+		return fmt.Errorf("unsupported %s language: %s", name, p.Language)
+	}
+	if p.Code == "" {
+		return fmt.Errorf("%s code is required", name)
+	}
+	return nil
+}
+
+func (req StressRequest) Validate() error {
+	if _, ok := LangImages[req.Language]; !ok {
+		return fmt.Errorf("unsupported language: %s", req.Language)
+	}
+	if err := req.Source.Validate(req.Language); err != nil {
+		return err
+	}
+	if err := req.Flags.Validate(req.Language); err != nil {
+		return err
+	}
+	if err := req.Reference.Validate("reference"); err != nil {
+		return err
+	}
+	if err := req.Generator.Validate("generator"); err != nil {
+		return err
+	}
+	if req.Iterations < 0 || req.Iterations > STRESS_MAX_ITERATIONS {
+		return fmt.Errorf("iterations must be at most %d", STRESS_MAX_ITERATIONS)
+	}
+	if req.MaxSize < 0 || req.MaxSize > STRESS_MAX_SIZE {
+		return fmt.Errorf("max size must be between 0 and %d", STRESS_MAX_SIZE)
+	}
+	if err := req.Compare.Validate(); err != nil {
+		return err
+	}
+	return req.Callback.Validate()
+}
+
+// Stress runs the solution on a pooled container and the generator and the
+// reference on private containers of their own until the outputs differ.
+func (dm *DockerManager) Stress(req StressRequest) (*StressResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	containerID, err := dm.FindContainer(req.Language)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+	defer func() {
+		if err := dm.DecreaseUser(containerID); err != nil {
+			log.Printf("Failed to remove container %s: %v", containerID, err)
+		}
+	}()
+
+	result, err := dm.stressIn(containerID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	dm.webhooks.Notify(req.Callback, EVENT_STRESS_COMPLETED, result.RunID, result)
+	return result, nil
+}
+
+func (dm *DockerManager) stressIn(containerID string, req StressRequest) (*StressResult, error) {
+	opt := LangImages[req.Language]
+	result := &StressResult{RunID: newID(), Seed: req.Seed}
+	if result.Seed == 0 {
+		result.Seed = time.Now().UnixNano()
+	}
+	iterations := req.Iterations
+	if iterations == 0 {
+		iterations = STRESS_DEFAULT_ITERATIONS
+	}
+	maxSize := req.MaxSize
+	if maxSize == 0 {
+		maxSize = STRESS_DEFAULT_MAX_SIZE
+	}
+
+	cmd, err := dm.buildCommand(req.Language, compileCaller{id: result.RunID}, req.Source, req.Flags)
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) {
+		result.Status = STRESS_COMPILE_ERROR
+		result.Message = compileErr.Output
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gen, err := dm.startJudgeProgram(req.Generator.Language, req.Generator.Code, req.Generator.Limits)
+	if errors.As(err, &compileErr) {
+		result.Status = STRESS_GENERATOR_ERROR
+		result.Message = compileErr.Output
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dm.closeJudgeProgram(gen)
+
+	ref, err := dm.startJudgeProgram(req.Reference.Language, req.Reference.Code, req.Reference.Limits)
+	if errors.As(err, &compileErr) {
+		result.Status = STRESS_REFERENCE_ERROR
+		result.Message = compileErr.Output
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dm.closeJudgeProgram(ref)
+
+	// Every run is cut short at the deadline, a run cut short only means the
+	// budget ran out
+	deadline := time.Now().Add(STRESS_TIME_BUDGET)
+	gen.deadline, ref.deadline = deadline, deadline
+	for i := 0; i < iterations && time.Now().Before(deadline); i++ {
+		seed := result.Seed + int64(i)
+		size := 1 + i*(maxSize-1)/max(iterations-1, 1)
+
+		genRun, outOfTime, err := dm.runJudgeProgram(gen, []string{strconv.FormatInt(seed, 10), strconv.Itoa(size)}, "")
+		if err != nil {
+			return nil, err
+		}
+		if outOfTime {
+			break
+		}
+		if verdict := runVerdict(genRun.RunSummary); verdict != "" {
+			result.Status = STRESS_GENERATOR_ERROR
+			result.Message = fmt.Sprintf("generator failed with seed %d: %s", seed, verdict)
+			return result, nil
+		}
+		input, _, err := genRun.outputBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		refRun, outOfTime, err := dm.runJudgeProgram(ref, nil, string(input))
+		if err != nil {
+			return nil, err
+		}
+		if outOfTime {
+			break
+		}
+		if verdict := runVerdict(refRun.RunSummary); verdict != "" {
+			result.Status = STRESS_REFERENCE_ERROR
+			result.Message = fmt.Sprintf("reference failed with seed %d: %s", seed, verdict)
+			return result, nil
+		}
+		expected, _, err := refRun.outputBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		spec := execSpec{
+			runID:  newID(),
+			cmd:    cmd,
+			limits: req.Limits,
+		}
+		spec.applyLimits(opt)
+		capped := spec.capWallTime(deadline)
+		run, err := dm.runBatch(containerID, opt, spec, string(input), nil)
+		if err != nil {
+			return nil, err
+		}
+		if capped && run.Reason == EXIT_REASON_TIMEOUT {
+			break
+		}
+		result.Iterations++
+
+		verdict := runVerdict(run.RunSummary)
+		output, _, err := run.outputBytes()
+		if err != nil {
+			return nil, err
+		}
+		if verdict == "" && !req.Compare.Equal(string(output), string(expected)) {
+			verdict = VERDICT_WRONG_ANSWER
+		}
+		if verdict == "" {
+			continue
+		}
+
+		result.Status = STRESS_FAILED
+		result.Verdict = verdict
+		result.Seed = seed
+		result.Size = size
+		result.Run = run
+		result.Input, result.Expected, result.Output, result.Encoding = encodeStressData(input, expected, output)
+		return result, nil
+	}
+
+	result.Status = STRESS_PASSED
+	return result, nil
+}
+
+// runJudgeProgram runs a helper program with extra arguments and stdin. It
+// reports whether the program was stopped by the deadline of p rather than
+// its own limits.
+func (dm *DockerManager) runJudgeProgram(p *judgeProgram, args []string, stdin string) (*ExecuteResult, bool, error) {
+	spec := execSpec{
+		runID:  newID(),
+		cmd:    append(append([]string(nil), p.cmd...), args...),
+		limits: p.limits,
+	}
+	spec.applyLimits(p.opt)
+	capped := spec.capWallTime(p.deadline)
+	run, err := dm.runBatch(p.containerID, p.opt, spec, stdin, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return run, capped && run.Reason == EXIT_REASON_TIMEOUT, nil
+}
+
+// encodeStressData encodes the failing case like run output, base64 when
+// any part is not valid UTF-8.
+func encodeStressData(input, expected, output []byte) (string, string, string, string) {
+	if utf8.Valid(input) && utf8.Valid(expected) && utf8.Valid(output) {
+		return string(input), string(expected), string(output), ""
+	}
+	enc := base64.StdEncoding.EncodeToString
+	return enc(input), enc(expected), enc(output), ENCODING_BASE64
+}
@@ -18,13 +18,21 @@ const (
 	COMPILED_FILES              = "/tmp/tmp_compiled"
 	CODE_FILES_DIR              = "/tmp/code_files"
 	CONTAINER_COMPILED_FILES    = "/tmp/tmp_compiled"
+	// Hidden test data, only mounted into the container of the judge program
+	// it is for
+	JUDGE_FILES           = "/tmp/judge_files"
+	CONTAINER_JUDGE_FILES = "/judge"
 )
 
 type LangOptions struct {
 	Image            string
 	IsCompiled       bool
 	ExecCmd          func(string) []string
-	CompileCmd       func(string) []string
+	CompileCmd       func(string) []string // run in the compile image, see compileInSandbox
+	CompileImage     string
+	MaxCompiles      int             // compiles running at once, COMPILE_WORKERS when 0
+	Packages         *PackageManager // nil when runs can't declare dependencies
+	WarmContainers   int             // idle started containers kept ready
 	MinCpu           int64
 	MinMem           int64
 	IncrementalMem   int64
@@ -33,10 +41,16 @@ type LangOptions struct {
 	MaxCpu           int64
 	Mounts           []mount.Mount
 	Env              []string
-	RunOnHost        func(string) []string
 	FileName         func(string) string
 	CpuIdleThreshold int64
 	MemIdleThreshold int64
+	WallTimeLimit    time.Duration
+	CPUTimeLimit     time.Duration
+	SourceName       string // what errors call the user's file
+	Preamble         string // prepended to the user's code
+	// Flags a run may ask for, mapped to the arguments they add
+	CompileFlags map[string][]string
+	RuntimeFlags map[string][]string
 }
 
 type ContainerResources struct {
@@ -51,8 +65,16 @@ type DockerManager struct {
 	filledContainers   map[string]map[string]int
 	runningContainers  map[string]int
 	containerResources map[string]ContainerResources
+	warmContainers     map[string][]string // started but not handed out yet
+	warming            map[string]int      // being started for the warm pool
 	ctx                context.Context
 	cancel             context.CancelFunc
+	sessionsMu         sync.Mutex
+	sessions           map[string]*Session
+	webhooks           *WebhookDispatcher
+	compileCache       *CompileCache
+	compiles           *compileScheduler
+	imageIDs           map[string]string // by image name, part of the compile cache key
 }
 
 type containerStats struct {
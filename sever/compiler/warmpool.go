@@ -0,0 +1,108 @@
+package compiler
+
+import (
+	"log"
+	"time"
+)
+
+// WARM_POOL_INTERVAL is how often the warm pools are checked, so a pool
+// whose container failed to start is filled again.
+const WARM_POOL_INTERVAL = 30 * time.Second
+
+// newContainer hands out a warm container of lang when there is one and
+// creates one otherwise, then tops the pool up in the background. Must be
+// called with dm.mu held.
+func (dm *DockerManager) newContainer(lang string) (string, error) {
+	defer dm.topUp(lang)
+
+	if pool := dm.warmContainers[lang]; len(pool) > 0 {
+		id := pool[len(pool)-1]
+		dm.warmContainers[lang] = pool[:len(pool)-1]
+		log.Print("Using warm container: ", id)
+		return id, nil
+	}
+	return dm.CreateContainer(lang)
+}
+
+// topUp starts as many containers as the warm pool of lang is missing. Must
+// be called with dm.mu held.
+func (dm *DockerManager) topUp(lang string) {
+	if dm.ctx.Err() != nil {
+		return
+	}
+	missing := LangImages[lang].WarmContainers - len(dm.warmContainers[lang]) - dm.warming[lang]
+	for range max(missing, 0) {
+		dm.warming[lang]++
+		go dm.warmUp(lang)
+	}
+}
+
+func (dm *DockerManager) warmUp(lang string) {
+	id, err := dm.startContainer(lang)
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.warming[lang]--
+	if err != nil {
+		log.Printf("Failed to start warm %s container: %v", lang, err)
+		return
+	}
+	dm.registerContainer(lang, id)
+	if dm.ctx.Err() != nil {
+		if err := dm.RemoveContainer(id, lang); err != nil {
+			log.Printf("Failed to remove container %s: %v", id, err)
+		}
+		return
+	}
+
+	dm.warmContainers[lang] = append(dm.warmContainers[lang], id)
+	log.Print("Warm container ready: ", id)
+}
+
+// KeepWarm fills the warm pools and keeps them filled until shutdown.
+func (dm *DockerManager) KeepWarm() {
+	ticker := time.NewTicker(WARM_POOL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		dm.mu.Lock()
+		for lang := range LangImages {
+			dm.topUp(lang)
+		}
+		dm.mu.Unlock()
+
+		select {
+		case <-dm.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isWarm reports whether the container is idle in a warm pool. Must be
+// called with dm.mu held.
+func (dm *DockerManager) isWarm(containerID string) bool {
+	for _, pool := range dm.warmContainers {
+		for _, id := range pool {
+			if id == containerID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (dm *DockerManager) removeWarmContainers() {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	for lang, pool := range dm.warmContainers {
+		for _, id := range pool {
+			if err := dm.RemoveContainer(id, lang); err != nil {
+				log.Printf("Failed to remove container %s: %v", id, err)
+			}
+		}
+		delete(dm.warmContainers, lang)
+	}
+}
@@ -0,0 +1,265 @@
+package compiler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	WEBHOOK_MAX_ATTEMPTS     = 5
+	WEBHOOK_INITIAL_BACKOFF  = time.Second
+	WEBHOOK_MAX_BACKOFF      = time.Minute
+	WEBHOOK_TIMEOUT          = 10 * time.Second
+	WEBHOOK_LOG_SIZE         = 1000
+	WEBHOOK_SIGNATURE_HEADER = "X-Signature-256"
+	WEBHOOK_EVENT_HEADER     = "X-Webhook-Event"
+	WEBHOOK_DELIVERY_HEADER  = "X-Webhook-Delivery"
+)
+
+const (
+	EVENT_RUN_COMPLETED = "run.completed"
+	EVENT_JOB_COMPLETED = "job.completed"
+)
+
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+// Callback asks for the result of a run to be POSTed to URL, signed with
+// HMAC-SHA256 of the body using Secret.
+type Callback struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func (cb *Callback) Validate() error {
+	if cb == nil {
+		return nil
+	}
+	u, err := url.Parse(cb.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback url must be an absolute http(s) url")
+	}
+	if cb.Secret == "" {
+		return errors.New("callback secret is required")
+	}
+	return nil
+}
+
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	RunID     string    `json:"run_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data"`
+}
+
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type Delivery struct {
+	ID       string            `json:"id"`
+	Event    string            `json:"event"`
+	RunID    string            `json:"run_id"`
+	URL      string            `json:"url"`
+	State    string            `json:"state"`
+	Attempts []DeliveryAttempt `json:"attempts"`
+}
+
+var errWebhookAddress = errors.New("callback address is not allowed")
+
+// WebhookDispatcher delivers completion callbacks in the background with
+// exponential backoff and keeps a bounded log of recent deliveries.
+type WebhookDispatcher struct {
+	Client         *http.Client
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Lets callbacks reach loopback and private addresses, for local testing
+	AllowPrivateHosts bool
+
+	mu         sync.Mutex
+	deliveries []*Delivery
+}
+
+func NewWebhookDispatcher() *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		MaxAttempts:    WEBHOOK_MAX_ATTEMPTS,
+		InitialBackoff: WEBHOOK_INITIAL_BACKOFF,
+		MaxBackoff:     WEBHOOK_MAX_BACKOFF,
+	}
+	// Addresses are checked once resolved, so neither DNS nor redirects can
+	// point a callback at the host or the cloud metadata service
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT, Control: d.checkAddress}
+	d.Client = &http.Client{
+		Timeout:   WEBHOOK_TIMEOUT,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	return d
+}
+
+func (d *WebhookDispatcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	if d.AllowPrivateHosts {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", errWebhookAddress, host)
+	}
+	return nil
+}
+
+// SignPayload returns the signature header value for body.
+func SignPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify queues the delivery of an event and returns its id right away. The
+// returned channel is closed once the delivery succeeded or gave up.
+func (d *WebhookDispatcher) Notify(cb *Callback, event, runID string, data any) (string, <-chan struct{}) {
+	done := make(chan struct{})
+	if cb == nil {
+		close(done)
+		return "", done
+	}
+
+	payload := WebhookEvent{
+		ID:        newID(),
+		Event:     event,
+		RunID:     runID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+	delivery := &Delivery{
+		ID:    payload.ID,
+		Event: event,
+		RunID: runID,
+		URL:   cb.URL,
+		State: DELIVERY_PENDING,
+	}
+
+	d.mu.Lock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > WEBHOOK_LOG_SIZE {
+		d.deliveries = d.deliveries[len(d.deliveries)-WEBHOOK_LOG_SIZE:]
+	}
+	d.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		d.deliver(cb, delivery, payload)
+	}()
+
+	return delivery.ID, done
+}
+
+func (d *WebhookDispatcher) deliver(cb *Callback, delivery *Delivery, payload WebhookEvent) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook %s: %v", delivery.ID, err)
+		d.setState(delivery, DELIVERY_FAILED)
+		return
+	}
+	signature := SignPayload(cb.Secret, body)
+
+	backoff := d.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(cb.URL, delivery, body, signature)
+		if err == nil && status >= 200 && status < 300 {
+			d.setState(delivery, DELIVERY_DELIVERED)
+			return
+		}
+
+		// Only failures that may go away are retried
+		retry := (err != nil && !errors.Is(err, errWebhookAddress)) ||
+			status == http.StatusTooManyRequests || status >= 500
+		if !retry || attempt >= d.MaxAttempts {
+			log.Printf("Webhook %s to %s failed after %d attempts", delivery.ID, cb.URL, attempt)
+			d.setState(delivery, DELIVERY_FAILED)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, d.MaxBackoff)
+	}
+}
+
+func (d *WebhookDispatcher) post(url string, delivery *Delivery, body []byte, signature string) (int, error) {
+	start := time.Now()
+	attempt := DeliveryAttempt{At: start}
+	defer func() {
+		attempt.DurationMs = time.Since(start).Milliseconds()
+		d.mu.Lock()
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		d.mu.Unlock()
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signature)
+	req.Header.Set(WEBHOOK_EVENT_HEADER, delivery.Event)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, delivery.ID)
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return 0, err
+	}
+	resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	return resp.StatusCode, nil
+}
+
+func (d *WebhookDispatcher) setState(delivery *Delivery, state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery.State = state
+}
+
+// Deliveries returns the delivery log, newest first, optionally only for one run.
+func (d *WebhookDispatcher) Deliveries(runID string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := []Delivery{}
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		delivery := d.deliveries[i]
+		if runID != "" && delivery.RunID != runID {
+			continue
+		}
+		copied := *delivery
+		copied.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+		list = append(list, copied)
+	}
+	return list
+}
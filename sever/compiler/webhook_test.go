@@ -0,0 +1,191 @@
+package compiler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDispatcher() *WebhookDispatcher {
+	d := NewWebhookDispatcher()
+	d.InitialBackoff = time.Millisecond
+	d.MaxBackoff = time.Millisecond
+	d.AllowPrivateHosts = true
+	return d
+}
+
+// receiver answers with the given status codes in turn, repeating the last.
+func receiver(t *testing.T, codes ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		w.WriteHeader(codes[min(n, len(codes))-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func waitDelivery(t *testing.T, d *WebhookDispatcher, done <-chan struct{}, runID string) Delivery {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery did not finish")
+	}
+	deliveries := d.Deliveries(runID)
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries for %s, want 1", len(deliveries), runID)
+	}
+	return deliveries[0]
+}
+
+func TestWebhookSignature(t *testing.T) {
+	secret := "s3cret"
+	received := make(chan *http.Request, 1)
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer srv.Close()
+
+	d := newTestDispatcher()
+	id, done := d.Notify(&Callback{URL: srv.URL, Secret: secret}, EVENT_RUN_COMPLETED, "run-1", RunSummary{ExitCode: 3})
+	delivery := waitDelivery(t, d, done, "run-1")
+	r := <-received
+
+	if got, want := r.Header.Get(WEBHOOK_SIGNATURE_HEADER), SignPayload(secret, body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if got := r.Header.Get(WEBHOOK_EVENT_HEADER); got != EVENT_RUN_COMPLETED {
+		t.Errorf("event header = %q", got)
+	}
+	if got := r.Header.Get(WEBHOOK_DELIVERY_HEADER); got != id {
+		t.Errorf("delivery header = %q, want %q", got, id)
+	}
+
+	var event struct {
+		ID    string     `json:"id"`
+		Event string     `json:"event"`
+		RunID string     `json:"run_id"`
+		Data  RunSummary `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("invalid body %s: %v", body, err)
+	}
+	if event.ID != id || event.Event != EVENT_RUN_COMPLETED || event.RunID != "run-1" || event.Data.ExitCode != 3 {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if delivery.State != DELIVERY_DELIVERED || len(delivery.Attempts) != 1 || delivery.Attempts[0].StatusCode != http.StatusOK {
+		t.Errorf("unexpected log entry %+v", delivery)
+	}
+	if delivery.URL != srv.URL || delivery.Event != EVENT_RUN_COMPLETED {
+		t.Errorf("log entry = %+v", delivery)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		state    string
+		attempts int
+	}{
+		{"success", []int{200}, DELIVERY_DELIVERED, 1},
+		{"retried after server errors", []int{500, 503, 204}, DELIVERY_DELIVERED, 3},
+		{"retried when rate limited", []int{429, 200}, DELIVERY_DELIVERED, 2},
+		{"client error is final", []int{400}, DELIVERY_FAILED, 1},
+		{"not found is final", []int{404, 200}, DELIVERY_FAILED, 1},
+		{"gives up after max attempts", []int{502}, DELIVERY_FAILED, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := receiver(t, tt.codes...)
+			d := newTestDispatcher()
+			d.MaxAttempts = 3
+
+			_, done := d.Notify(&Callback{URL: srv.URL, Secret: "x"}, EVENT_JOB_COMPLETED, "job", nil)
+			delivery := waitDelivery(t, d, done, "job")
+
+			if delivery.State != tt.state {
+				t.Errorf("state = %s, want %s", delivery.State, tt.state)
+			}
+			if len(delivery.Attempts) != tt.attempts || int(calls.Load()) != tt.attempts {
+				t.Errorf("got %d logged attempts and %d requests, want %d", len(delivery.Attempts), calls.Load(), tt.attempts)
+			}
+			for i, attempt := range delivery.Attempts {
+				if want := tt.codes[min(i, len(tt.codes)-1)]; attempt.StatusCode != want {
+					t.Errorf("attempt %d status = %d, want %d", i+1, attempt.StatusCode, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	srv, calls := receiver(t, 200)
+	d := newTestDispatcher()
+	d.AllowPrivateHosts = false
+
+	_, done := d.Notify(&Callback{URL: srv.URL, Secret: "x"}, EVENT_RUN_COMPLETED, "run", nil)
+	delivery := waitDelivery(t, d, done, "run")
+
+	if calls.Load() != 0 {
+		t.Errorf("loopback receiver got %d requests", calls.Load())
+	}
+	if delivery.State != DELIVERY_FAILED || len(delivery.Attempts) != 1 || delivery.Attempts[0].Error == "" {
+		t.Errorf("unexpected log entry %+v", delivery)
+	}
+}
+
+func TestWebhookCheckAddress(t *testing.T) {
+	d := NewWebhookDispatcher()
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.0.0.5:80", false},
+		{"172.16.1.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+	}
+	for _, tt := range tests {
+		err := d.checkAddress("tcp", tt.address, nil)
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkAddress(%s) = %v, want allowed %v", tt.address, err, tt.allowed)
+		}
+	}
+}
+
+func TestCallbackValidate(t *testing.T) {
+	tests := []struct {
+		cb *Callback
+		ok bool
+	}{
+		{nil, true},
+		{&Callback{URL: "https://example.com/hook", Secret: "x"}, true},
+		{&Callback{URL: "http://example.com:8080/hook", Secret: "x"}, true},
+		{&Callback{URL: "https://example.com/hook"}, false},
+		{&Callback{URL: "ftp://example.com/hook", Secret: "x"}, false},
+		{&Callback{URL: "/hook", Secret: "x"}, false},
+		{&Callback{URL: "://bad", Secret: "x"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cb.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok %v", tt.cb, err, tt.ok)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
 	"server/compiler"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,11 +22,19 @@ func main() {
 		log.Fatalf("Failed to initialize Docker manager: %v", err)
 	}
 
+	// Local setups send callbacks to receivers on the same machine
+	dockerManager.Webhooks().AllowPrivateHosts = os.Getenv("WEBHOOK_ALLOW_PRIVATE_HOSTS") == "1"
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
 	app := fiber.New()
 
 	defer dockerManager.Shutdown()
 
+	jobs := compiler.NewJobQueue(dockerManager, compiler.JOB_WORKERS)
+	defer jobs.Close()
+
 	go dockerManager.MonitorResources()
+	go dockerManager.KeepWarm()
 
 	app.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
@@ -32,36 +44,159 @@ func main() {
 	})
 
 	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
+		client := compiler.NewClientConn(c, compiler.NegotiateProtocol(c.Subprotocol(), c.Query("version")))
+		defer client.Drain()
+
+		if sessionID := c.Query("session"); sessionID != "" {
+			session, err := dockerManager.FindSession(sessionID)
+			if err != nil {
+				client.SendError("", err)
+				return
+			}
+			lastSeq, _ := strconv.ParseUint(c.Query("last_seq"), 10, 64)
+			session.Serve(client, lastSeq)
+			return
+		}
+
 		language := c.Query("language")
 		if language == "" {
 			log.Println("Language not specified")
-			c.WriteMessage(websocket.TextMessage, []byte("error: Language not specified"))
+			client.SendError("", errors.New("Language not specified"))
 			return
 		}
 
 		containerID, err := dockerManager.FindContainer(language)
 		if err != nil {
 			log.Printf("Failed to start container: %v", err)
-			c.WriteMessage(websocket.TextMessage, []byte("error: "+err.Error()))
+			client.SendError("", err)
 			return
 		}
 
-		if err := c.WriteMessage(websocket.TextMessage, []byte("container_id: "+containerID)); err != nil {
-			log.Printf("Failed to send message: %v", err)
-			return
+		session := dockerManager.StartSession(language, containerID, client.Protocol())
+		session.Serve(client, 0)
+	}, websocket.Config{
+		Subprotocols: []string{compiler.PROTOCOL_V1},
+	}))
+
+	app.Post("/api/v1/run", func(c *fiber.Ctx) error {
+		var req compiler.ExecuteRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := req.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
 
-		defer func() {
-			if err := dockerManager.DecreaseUser(containerID); err != nil {
-				log.Printf("Failed to remove container %s: %v", containerID, err)
-			}
-		}()
+		result, err := dockerManager.Execute(req)
+		if err != nil {
+			log.Printf("Run failed: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(result)
+	})
 
-		if err := dockerManager.RunLiveCode(language, containerID, c); err != nil {
-			log.Printf("Interactive session error: %v", err)
-			c.WriteMessage(websocket.TextMessage, []byte("error: "+err.Error()))
+	app.Post("/api/v1/check", func(c *fiber.Ctx) error {
+		var req compiler.CheckRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := req.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		result, err := dockerManager.Check(req)
+		if err != nil {
+			log.Printf("Check failed: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(result)
+	})
+
+	app.Post("/api/v1/judge", func(c *fiber.Ctx) error {
+		var req compiler.JudgeRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := req.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
-	}))
+
+		result, err := dockerManager.Judge(req)
+		if err != nil {
+			log.Printf("Judge failed: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(result)
+	})
+
+	app.Post("/api/v1/stress", func(c *fiber.Ctx) error {
+		var req compiler.StressRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err := req.Validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		result, err := dockerManager.Stress(req)
+		if err != nil {
+			log.Printf("Stress test failed: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(result)
+	})
+
+	app.Post("/jobs", func(c *fiber.Ctx) error {
+		var req compiler.ExecuteRequest
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		status, err := jobs.Submit(req)
+		if errors.Is(err, compiler.ErrQueueFull) {
+			return fiber.NewError(fiber.StatusServiceUnavailable, err.Error())
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		return c.Status(fiber.StatusAccepted).JSON(status)
+	})
+
+	app.Get("/jobs/:id", func(c *fiber.Ctx) error {
+		status, err := jobs.Get(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		return c.JSON(status)
+	})
+
+	app.Delete("/jobs/:id", func(c *fiber.Ctx) error {
+		status, err := jobs.Cancel(c.Params("id"))
+		if errors.Is(err, compiler.ErrJobNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		return c.JSON(status)
+	})
+
+	// The log holds the callback urls of every user
+	app.Get("/api/v1/webhooks/deliveries", adminOnly(adminToken), func(c *fiber.Ctx) error {
+		return c.JSON(dockerManager.Webhooks().Deliveries(c.Query("run_id")))
+	})
+
+	app.Get("/api/v1/compile-cache", adminOnly(adminToken), func(c *fiber.Ctx) error {
+		return c.JSON(dockerManager.CompileCache().Stats())
+	})
+
+	app.Get("/artifacts/:id", func(c *fiber.Ctx) error {
+		path, err := compiler.ArtifactPath(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		return c.Download(path, "output.log")
+	})
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
@@ -79,3 +214,15 @@ func main() {
 		log.Fatalf("Server error: %v", err)
 	}
 }
+
+// adminOnly lets through requests with the admin token as bearer token, none
+// when no token is set.
+func adminOnly(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		given := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return fiber.ErrUnauthorized
+		}
+		return c.Next()
+	}
+}